@@ -1,9 +1,10 @@
 module github.com/datawire/profile-make
 
-go 1.13
+go 1.19
 
 require (
 	github.com/alessio/shellescape v0.0.0-20190409004728-b115ca0f9053
 	github.com/pkg/errors v0.8.1
 	github.com/spf13/pflag v1.0.3
+	mvdan.cc/sh/v3 v3.7.0
 )
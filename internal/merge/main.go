@@ -0,0 +1,175 @@
+package merge
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+type input struct {
+	Label   string
+	File    string
+	Offset  time.Duration
+	Profile protocol.Profile
+}
+
+// parseInput parses a "[LABEL=]FILE" positional argument.  If no label is given, the label is the
+// file's basename sans ".json" or ".json.gz".
+func parseInput(arg string) input {
+	var ret input
+	if eq := strings.Index(arg, "="); eq >= 0 {
+		ret.Label = arg[:eq]
+		ret.File = arg[eq+1:]
+	} else {
+		ret.File = arg
+	}
+	if ret.Label == "" {
+		ret.Label = strings.TrimSuffix(strings.TrimSuffix(filepath.Base(ret.File), ".gz"), ".json")
+	}
+	return ret
+}
+
+func Main(args ...string) error {
+	argparser := pflag.NewFlagSet("merge", pflag.ContinueOnError)
+	var (
+		argOffsets = argparser.StringArray("offset", nil, "Shift an input's timestamps, as LABEL=DURATION (may be given multiple times)")
+	)
+	err := argparser.Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(argparser.Args()) == 0 {
+		return errors.New("expected at least one profile to merge")
+	}
+
+	inputs := make([]*input, 0, len(argparser.Args()))
+	byLabel := make(map[string]*input, len(argparser.Args()))
+	for _, arg := range argparser.Args() {
+		in := parseInput(arg)
+		if _, dup := byLabel[in.Label]; dup {
+			return errors.Errorf("duplicate label: %q", in.Label)
+		}
+		inputs = append(inputs, &in)
+		byLabel[in.Label] = &in
+	}
+	for _, arg := range *argOffsets {
+		eq := strings.LastIndex(arg, "=")
+		if eq < 0 {
+			return errors.Errorf("invalid --offset: %q: expected LABEL=DURATION", arg)
+		}
+		in, ok := byLabel[arg[:eq]]
+		if !ok {
+			return errors.Errorf("invalid --offset: %q: no input labeled %q", arg, arg[:eq])
+		}
+		in.Offset, err = time.ParseDuration(arg[eq+1:])
+		if err != nil {
+			return errors.Wrapf(err, "invalid --offset: %q", arg)
+		}
+	}
+
+	for _, in := range inputs {
+		in.Profile, err = protocol.ReadProfileFile(in.File)
+		if err != nil {
+			return err
+		}
+	}
+
+	return protocol.NewEncoder(os.Stdout).Encode(mergeProfiles(inputs))
+}
+
+// mergeProfiles combines several profiles in to one.  Each input profile becomes a "lane": a
+// synthetic top-level command (whose target is the input's label) that has the input's top-level
+// make as a sub-make.  A lane depends on every lane that finished before it started, so that the
+// compact layout keeps sequential invocations in order.  The inputs' samples (see `run
+// --sample-interval`) are all kept, in time order.
+func mergeProfiles(inputs []*input) protocol.Profile {
+	var dirs []string
+	for _, in := range inputs {
+		shiftCommands(in.Profile.Commands, in.Offset)
+		in.Profile.StartTime = in.Profile.StartTime.Add(in.Offset)
+		in.Profile.FinishTime = in.Profile.FinishTime.Add(in.Offset)
+		for i := range in.Profile.Samples {
+			in.Profile.Samples[i].Time = in.Profile.Samples[i].Time.Add(in.Offset)
+		}
+		if len(in.Profile.Commands) > 0 {
+			dirs = append(dirs, in.Profile.Commands[0].MakeDir)
+		}
+	}
+	sort.SliceStable(inputs, func(i, j int) bool {
+		return inputs[i].Profile.StartTime.Before(inputs[j].Profile.StartTime)
+	})
+
+	var ret protocol.Profile
+	dir := commonDir(dirs)
+	// The inputs may have been profiled on different machines; only say how many CPUs there
+	// were if they all agree.
+	ret.NumCPU = inputs[0].Profile.NumCPU
+	for _, in := range inputs {
+		if in.Profile.NumCPU != ret.NumCPU {
+			ret.NumCPU = 0
+		}
+	}
+	for _, in := range inputs {
+		if ret.StartTime.IsZero() || in.Profile.StartTime.Before(ret.StartTime) {
+			ret.StartTime = in.Profile.StartTime
+		}
+		if in.Profile.FinishTime.After(ret.FinishTime) {
+			ret.FinishTime = in.Profile.FinishTime
+		}
+		var deps []string
+		for _, other := range inputs {
+			if other != in && !other.Profile.FinishTime.After(in.Profile.StartTime) {
+				deps = append(deps, other.Label)
+			}
+		}
+		ret.Commands = append(ret.Commands, protocol.ProfiledCommand{
+			StartTime:  in.Profile.StartTime,
+			FinishTime: in.Profile.FinishTime,
+
+			MakeDir: dir,
+
+			RecipeTarget:       in.Label,
+			RecipeDependencies: deps,
+
+			Args: []string{in.Label},
+
+			MergedProfile: true,
+			SubCommands:   in.Profile.Commands,
+		})
+		ret.Samples = append(ret.Samples, in.Profile.Samples...)
+	}
+	sort.SliceStable(ret.Samples, func(i, j int) bool {
+		return ret.Samples[i].Time.Before(ret.Samples[j].Time)
+	})
+	return ret
+}
+
+func shiftCommands(cmds []protocol.ProfiledCommand, offset time.Duration) {
+	for i := range cmds {
+		cmds[i].StartTime = cmds[i].StartTime.Add(offset)
+		cmds[i].FinishTime = cmds[i].FinishTime.Add(offset)
+		shiftCommands(cmds[i].SubCommands, offset)
+	}
+}
+
+// commonDir returns the deepest directory that contains all of the given directories.
+func commonDir(dirs []string) string {
+	if len(dirs) == 0 {
+		return "/"
+	}
+	common := filepath.Clean(dirs[0])
+	for _, dir := range dirs[1:] {
+		dir = filepath.Clean(dir)
+		for common != "/" && common != "." && dir != common && !strings.HasPrefix(dir, common+"/") {
+			common = filepath.Dir(common)
+		}
+	}
+	return common
+}
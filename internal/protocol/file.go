@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// gzipMagic is the first 2 bytes of every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// umask is the process's umask.  The only way to read it is to set it, so it's read once, at
+// startup, before there are other goroutines creating files that could race with it being 0.
+var umask = func() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask)
+}()
+
+// ReadProfile reads a profile, decompressing it first if it's gzipped.
+func ReadProfile(r io.Reader) (Profile, error) {
+	var profile Profile
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return profile, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = buffered
+	}
+	err := NewDecoder(r).Decode(&profile)
+	return profile, err
+}
+
+// ReadProfileFile is ReadProfile for a filename; "-" is stdin.
+func ReadProfileFile(filename string) (Profile, error) {
+	if filename == "-" {
+		return ReadProfile(os.Stdin)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return Profile{}, err
+	}
+	defer file.Close()
+	profile, err := ReadProfile(file)
+	if err != nil {
+		return profile, errors.Wrapf(err, "%s", filename)
+	}
+	return profile, nil
+}
+
+// WriteProfileFile writes a profile to a filename; "-" is stdout.  If the filename ends in ".gz",
+// the profile is gzipped.  The file is replaced atomically, so that it's never left half-written,
+// and whatever was there before is never left mixed in to it.
+func WriteProfileFile(filename string, profile Profile) error {
+	if filename == "-" {
+		return NewEncoder(os.Stdout).Encode(profile)
+	}
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	// TempFile makes it 0600; make it the usual 0666 less the umask, like os.Create would.
+	if err := tmp.Chmod(0666 &^ umask); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(filename, ".gz") {
+		gz := gzip.NewWriter(tmp)
+		if err := NewEncoder(gz).Encode(profile); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	} else {
+		if err := NewEncoder(tmp).Encode(profile); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	tmp = nil
+	return nil
+}
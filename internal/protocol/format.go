@@ -0,0 +1,380 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// There are 2 versions of the profile file format:
+//
+// Version 1 is a Profile, as a single JSON document.  Every command spells out its directory, its
+// dependencies, and its arguments in full, so a big build's profile is mostly the same paths over
+// and over again, and reading it means holding all of that text in memory at once.
+//
+// Version 2 is a stream of JSON values, one per line.  The first is a v2Header.  Each one after
+// that is a v2Record: either more entries for the string table or the list table, which the
+// commands refer to by index, or a command.  The commands come in post-order (each command's
+// sub-commands come right before it), so that each one can be put in place as soon as it's read.
+// Any samples come after the commands, one per v2Record.
+//
+// Version 1 files have no "Format" field, so the first value in the file says which it is.
+
+// FormatVersion is the version of the profile file format that is written.
+const FormatVersion = 2
+
+type v2Header struct {
+	Format      int
+	StartTime   time.Time
+	FinishTime  time.Time
+	Interrupted bool   `json:",omitempty"`
+	MakeVersion string `json:",omitempty"`
+	OutputSync  string `json:",omitempty"`
+	NumCPU      int    `json:",omitempty"`
+}
+
+type v2Record struct {
+	// Strings are appended to the string table; string 0 is "".
+	Strings []string `json:",omitempty"`
+	// Lists are appended to the list table, as indexes in to the string table; list 0 is nil.
+	Lists   [][]int    `json:",omitempty"`
+	Command *v2Command `json:",omitempty"`
+	Sample  *v2Sample  `json:",omitempty"`
+}
+
+// v2Command is a ProfiledCommand, with the strings and lists replaced by indexes in to the tables,
+// and the times as offsets from the profile's StartTime.
+type v2Command struct {
+	Start  time.Duration
+	Finish time.Duration
+
+	MakeLevel      uint `json:",omitempty"`
+	MakeRestarts   uint `json:",omitempty"`
+	MakeDir        int  `json:",omitempty"`
+	MakeOutputSync int  `json:",omitempty"`
+
+	RecipeTarget                int   `json:",omitempty"`
+	RecipeSource                int   `json:",omitempty"`
+	RecipeDependencies          int   `json:",omitempty"`
+	RecipeOrderOnlyDependencies int   `json:",omitempty"`
+	RecipeNewerDependencies     int   `json:",omitempty"`
+	RecipeTargetExisted         *bool `json:",omitempty"`
+
+	Shim          bool `json:",omitempty"`
+	MergedProfile bool `json:",omitempty"`
+
+	Args       int
+	ExitCode   int
+	UserTime   time.Duration `json:",omitempty"`
+	SystemTime time.Duration `json:",omitempty"`
+	TimedOut   bool          `json:",omitempty"`
+	Unfinished bool          `json:",omitempty"`
+
+	// SubCommands is how many of the commands right before this one (not counting their own
+	// sub-commands) are this one's sub-commands.
+	SubCommands int `json:",omitempty"`
+}
+
+// v2Sample is a Sample, with the time as an offset from the profile's StartTime.
+type v2Sample struct {
+	Time time.Duration
+
+	LoadAvg float64
+	CPUBusy float64
+
+	MemTotal     uint64
+	MemAvailable uint64
+	SwapTotal    uint64 `json:",omitempty"`
+	SwapFree     uint64 `json:",omitempty"`
+
+	DiskRead    uint64 `json:",omitempty"`
+	DiskWritten uint64 `json:",omitempty"`
+}
+
+// An Encoder writes profiles in the current format.
+type Encoder struct {
+	w *bufio.Writer
+	j *json.Encoder
+
+	strings map[string]int
+	lists   map[string]int
+	pending v2Record
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	buffered := bufio.NewWriter(w)
+	return &Encoder{
+		w: buffered,
+		j: json.NewEncoder(buffered),
+	}
+}
+
+func (enc *Encoder) Encode(profile Profile) error {
+	enc.strings = map[string]int{"": 0}
+	enc.lists = make(map[string]int)
+	err := enc.j.Encode(v2Header{
+		Format:      FormatVersion,
+		StartTime:   profile.StartTime,
+		FinishTime:  profile.FinishTime,
+		Interrupted: profile.Interrupted,
+		MakeVersion: profile.MakeVersion,
+		OutputSync:  profile.OutputSync,
+		NumCPU:      profile.NumCPU,
+	})
+	if err != nil {
+		return err
+	}
+	if err := enc.encodeCommands(profile.StartTime, profile.Commands); err != nil {
+		return err
+	}
+	for _, sample := range profile.Samples {
+		err := enc.j.Encode(v2Record{Sample: &v2Sample{
+			Time: sample.Time.Sub(profile.StartTime),
+
+			LoadAvg: sample.LoadAvg,
+			CPUBusy: sample.CPUBusy,
+
+			MemTotal:     sample.MemTotal,
+			MemAvailable: sample.MemAvailable,
+			SwapTotal:    sample.SwapTotal,
+			SwapFree:     sample.SwapFree,
+
+			DiskRead:    sample.DiskRead,
+			DiskWritten: sample.DiskWritten,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return enc.w.Flush()
+}
+
+func (enc *Encoder) encodeCommands(epoch time.Time, cmds []ProfiledCommand) error {
+	for i := range cmds {
+		cmd := &cmds[i]
+		if err := enc.encodeCommands(epoch, cmd.SubCommands); err != nil {
+			return err
+		}
+		record := v2Command{
+			Start:  cmd.StartTime.Sub(epoch),
+			Finish: cmd.FinishTime.Sub(epoch),
+
+			MakeLevel:      cmd.MakeLevel,
+			MakeRestarts:   cmd.MakeRestarts,
+			MakeDir:        enc.intern(cmd.MakeDir),
+			MakeOutputSync: enc.intern(cmd.MakeOutputSync),
+
+			RecipeTarget:                enc.intern(cmd.RecipeTarget),
+			RecipeSource:                enc.intern(cmd.RecipeSource),
+			RecipeDependencies:          enc.internList(cmd.RecipeDependencies),
+			RecipeOrderOnlyDependencies: enc.internList(cmd.RecipeOrderOnlyDependencies),
+			RecipeNewerDependencies:     enc.internList(cmd.RecipeNewerDependencies),
+			RecipeTargetExisted:         cmd.RecipeTargetExisted,
+
+			Shim:          cmd.Shim,
+			MergedProfile: cmd.MergedProfile,
+
+			Args:       enc.internList(cmd.Args),
+			ExitCode:   cmd.ExitCode,
+			UserTime:   cmd.UserTime,
+			SystemTime: cmd.SystemTime,
+			TimedOut:   cmd.TimedOut,
+			Unfinished: cmd.Unfinished,
+
+			SubCommands: len(cmd.SubCommands),
+		}
+		// flush the new table entries that the command refers to first
+		if len(enc.pending.Strings) > 0 || len(enc.pending.Lists) > 0 {
+			if err := enc.j.Encode(enc.pending); err != nil {
+				return err
+			}
+			enc.pending = v2Record{}
+		}
+		if err := enc.j.Encode(v2Record{Command: &record}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (enc *Encoder) intern(str string) int {
+	id, ok := enc.strings[str]
+	if !ok {
+		id = len(enc.strings)
+		enc.strings[str] = id
+		enc.pending.Strings = append(enc.pending.Strings, str)
+	}
+	return id
+}
+
+func (enc *Encoder) internList(list []string) int {
+	if len(list) == 0 {
+		return 0
+	}
+	key := strings.Join(list, "\x00")
+	id, ok := enc.lists[key]
+	if !ok {
+		ids := make([]int, len(list))
+		for i, str := range list {
+			ids[i] = enc.intern(str)
+		}
+		id = len(enc.lists) + 1
+		enc.lists[key] = id
+		enc.pending.Lists = append(enc.pending.Lists, ids)
+	}
+	return id
+}
+
+// A Decoder reads profiles in any version of the format.  Version 2 profiles are read a line at a
+// time, and commands share the strings and lists that they have in common, so reading one takes
+// not much more memory than the resulting Profile.  Because of that sharing, the slices in the
+// resulting commands must not be modified in place.
+type Decoder struct {
+	j *json.Decoder
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		j: json.NewDecoder(r),
+	}
+}
+
+func (dec *Decoder) Decode(profile *Profile) error {
+	var first struct {
+		Format int
+		Profile
+	}
+	if err := dec.j.Decode(&first); err != nil {
+		return err
+	}
+	switch first.Format {
+	case 0:
+		*profile = first.Profile
+		return nil
+	case 2:
+		*profile = first.Profile
+		return dec.decodeV2(profile)
+	default:
+		return errors.Errorf("profile is in format version %d, but this version of profile-make only understands up to version %d",
+			first.Format, FormatVersion)
+	}
+}
+
+func (dec *Decoder) decodeV2(profile *Profile) error {
+	strs := []string{""}
+	lists := [][]string{nil}
+	str := func(id int) (string, error) {
+		if id < 0 || id >= len(strs) {
+			return "", errors.Errorf("invalid profile: no string %d", id)
+		}
+		return strs[id], nil
+	}
+	list := func(id int) ([]string, error) {
+		if id < 0 || id >= len(lists) {
+			return nil, errors.Errorf("invalid profile: no list %d", id)
+		}
+		return lists[id], nil
+	}
+
+	var stack []ProfiledCommand
+	for {
+		var record v2Record
+		if err := dec.j.Decode(&record); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		strs = append(strs, record.Strings...)
+		for _, ids := range record.Lists {
+			l := make([]string, len(ids))
+			for i, id := range ids {
+				var err error
+				if l[i], err = str(id); err != nil {
+					return err
+				}
+			}
+			lists = append(lists, l)
+		}
+		if rec := record.Sample; rec != nil {
+			profile.Samples = append(profile.Samples, Sample{
+				Time: profile.StartTime.Add(rec.Time),
+
+				LoadAvg: rec.LoadAvg,
+				CPUBusy: rec.CPUBusy,
+
+				MemTotal:     rec.MemTotal,
+				MemAvailable: rec.MemAvailable,
+				SwapTotal:    rec.SwapTotal,
+				SwapFree:     rec.SwapFree,
+
+				DiskRead:    rec.DiskRead,
+				DiskWritten: rec.DiskWritten,
+			})
+		}
+		if record.Command == nil {
+			continue
+		}
+		rec := record.Command
+		if rec.SubCommands < 0 || rec.SubCommands > len(stack) {
+			return errors.Errorf("invalid profile: command has %d sub-commands, but only %d came before it",
+				rec.SubCommands, len(stack))
+		}
+		cmd := ProfiledCommand{
+			StartTime:  profile.StartTime.Add(rec.Start),
+			FinishTime: profile.StartTime.Add(rec.Finish),
+
+			MakeLevel:    rec.MakeLevel,
+			MakeRestarts: rec.MakeRestarts,
+
+			RecipeTargetExisted: rec.RecipeTargetExisted,
+
+			Shim:          rec.Shim,
+			MergedProfile: rec.MergedProfile,
+
+			ExitCode:   rec.ExitCode,
+			UserTime:   rec.UserTime,
+			SystemTime: rec.SystemTime,
+			TimedOut:   rec.TimedOut,
+			Unfinished: rec.Unfinished,
+		}
+		var err error
+		for _, s := range []struct {
+			dst *string
+			id  int
+		}{
+			{&cmd.MakeDir, rec.MakeDir},
+			{&cmd.MakeOutputSync, rec.MakeOutputSync},
+			{&cmd.RecipeTarget, rec.RecipeTarget},
+			{&cmd.RecipeSource, rec.RecipeSource},
+		} {
+			if *s.dst, err = str(s.id); err != nil {
+				return err
+			}
+		}
+		for _, l := range []struct {
+			dst *[]string
+			id  int
+		}{
+			{&cmd.RecipeDependencies, rec.RecipeDependencies},
+			{&cmd.RecipeOrderOnlyDependencies, rec.RecipeOrderOnlyDependencies},
+			{&cmd.RecipeNewerDependencies, rec.RecipeNewerDependencies},
+			{&cmd.Args, rec.Args},
+		} {
+			if *l.dst, err = list(l.id); err != nil {
+				return err
+			}
+		}
+		if rec.SubCommands > 0 {
+			cmd.SubCommands = append([]ProfiledCommand(nil), stack[len(stack)-rec.SubCommands:]...)
+			stack = stack[:len(stack)-rec.SubCommands]
+		}
+		stack = append(stack, cmd)
+	}
+	profile.Commands = stack
+	return nil
+}
@@ -0,0 +1,224 @@
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatRoundTrip(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	no, yes := false, true
+
+	profile := Profile{
+		StartTime:   start,
+		FinishTime:  at(5000),
+		Interrupted: true,
+		MakeVersion: "GNU Make 4.3",
+		OutputSync:  "target",
+		NumCPU:      8,
+		Commands: []ProfiledCommand{
+			{
+				StartTime:      at(10),
+				FinishTime:     at(4000),
+				MakeDir:        "/src",
+				MakeOutputSync: "target",
+				RecipeTarget:   "/src/all",
+				RecipeSource:   "/src/Makefile:3",
+				Args:           []string{"/bin/sh", "-c", "$(MAKE) -C sub"},
+				SubCommands: []ProfiledCommand{
+					{
+						StartTime:           at(20),
+						FinishTime:          at(1000),
+						MakeLevel:           1,
+						MakeDir:             "/src/sub",
+						RecipeTarget:        "/src/sub/a.o",
+						RecipeDependencies:  []string{"/src/sub/a.c", "/src/sub/a.h"},
+						RecipeTargetExisted: &no,
+						Args:                []string{"/bin/sh", "-c", "cc -c a.c"},
+						UserTime:            700 * time.Millisecond,
+						SystemTime:          100 * time.Millisecond,
+						SubCommands: []ProfiledCommand{
+							{
+								StartTime:  at(30),
+								FinishTime: at(900),
+								MakeLevel:  1,
+								MakeDir:    "/src/sub",
+								Shim:       true,
+								Args:       []string{"cc", "-c", "a.c"},
+							},
+						},
+					},
+					{
+						StartTime:                   at(1100),
+						FinishTime:                  at(3900),
+						MakeLevel:                   1,
+						MakeRestarts:                2,
+						MakeDir:                     "/src/sub",
+						RecipeTarget:                "/src/sub/b.o",
+						RecipeDependencies:          []string{"/src/sub/a.c", "/src/sub/a.h"}, // the same list again
+						RecipeOrderOnlyDependencies: []string{"/src/sub/dir"},
+						RecipeNewerDependencies:     []string{"/src/sub/a.h"},
+						RecipeTargetExisted:         &yes,
+						Args:                        []string{"/bin/sh", "-c", "sleep 10"},
+						ExitCode:                    -1,
+						TimedOut:                    true,
+					},
+				},
+			},
+			{
+				StartTime:     at(4000),
+				FinishTime:    at(5000),
+				RecipeTarget:  "other.json",
+				MergedProfile: true,
+				Args:          []string{},
+				Unfinished:    true,
+				SubCommands:   []ProfiledCommand{},
+			},
+		},
+		Samples: []Sample{
+			{Time: at(0), LoadAvg: 0.5, CPUBusy: 0.25, MemTotal: 1 << 30, MemAvailable: 1 << 29},
+			{Time: at(1000), LoadAvg: 1.5, CPUBusy: 1, MemTotal: 1 << 30, MemAvailable: 1 << 28,
+				SwapTotal: 1 << 20, SwapFree: 1 << 19, DiskRead: 4096, DiskWritten: 8192},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(profile); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), `"/src/sub/a.c"`); n != 1 {
+		t.Errorf("the string \"/src/sub/a.c\" was written %d times, want 1:\n%s", n, buf.String())
+	}
+
+	var got Profile
+	if err := NewDecoder(&buf).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	// Empty lists are written the same as no list at all.
+	want := profile
+	want.Commands = append([]ProfiledCommand(nil), profile.Commands...)
+	want.Commands[1].Args = nil
+	want.Commands[1].SubCommands = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip changed the profile:\ngot:  %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestDecodeV1(t *testing.T) {
+	input := `{
+		"StartTime": "2020-01-02T03:04:05Z",
+		"FinishTime": "2020-01-02T03:04:07Z",
+		"Commands": [
+			{
+				"StartTime": "2020-01-02T03:04:05.5Z",
+				"FinishTime": "2020-01-02T03:04:06.5Z",
+				"MakeLevel": 0,
+				"MakeRestarts": 0,
+				"MakeDir": "/src",
+				"RecipeTarget": "/src/all",
+				"RecipeDependencies": ["/src/a.o"],
+				"Args": ["/bin/sh", "-c", "$(MAKE) a.o"],
+				"ProcessState": null,
+				"ExitCode": 0,
+				"UserTime": 1000000,
+				"SystemTime": 0,
+				"SubCommands": [
+					{
+						"StartTime": "2020-01-02T03:04:06Z",
+						"FinishTime": "2020-01-02T03:04:06.25Z",
+						"MakeLevel": 1,
+						"MakeDir": "/src",
+						"RecipeTarget": "/src/a.o",
+						"Args": ["/bin/sh", "-c", "cc -c a.c"],
+						"ExitCode": 1
+					}
+				]
+			}
+		]
+	}`
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := Profile{
+		StartTime:  start,
+		FinishTime: start.Add(2 * time.Second),
+		Commands: []ProfiledCommand{{
+			StartTime:          start.Add(500 * time.Millisecond),
+			FinishTime:         start.Add(1500 * time.Millisecond),
+			MakeDir:            "/src",
+			RecipeTarget:       "/src/all",
+			RecipeDependencies: []string{"/src/a.o"},
+			Args:               []string{"/bin/sh", "-c", "$(MAKE) a.o"},
+			UserTime:           time.Millisecond,
+			SubCommands: []ProfiledCommand{{
+				StartTime:    start.Add(time.Second),
+				FinishTime:   start.Add(1250 * time.Millisecond),
+				MakeLevel:    1,
+				MakeDir:      "/src",
+				RecipeTarget: "/src/a.o",
+				Args:         []string{"/bin/sh", "-c", "cc -c a.c"},
+				ExitCode:     1,
+			}},
+		}},
+	}
+
+	var got Profile
+	if err := NewDecoder(strings.NewReader(input)).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:  %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	const header = `{"Format":2,"StartTime":"2020-01-02T03:04:05Z","FinishTime":"2020-01-02T03:04:07Z"}` + "\n"
+	testcases := map[string]struct {
+		Input string
+		Err   string
+	}{
+		"future format": {
+			Input: `{"Format":3,"StartTime":"2020-01-02T03:04:05Z"}`,
+			Err:   "format version 3",
+		},
+		"string index": {
+			Input: header +
+				`{"Strings":["/src"]}` + "\n" +
+				`{"Command":{"Start":0,"Finish":1,"MakeDir":2,"Args":0,"ExitCode":0}}`,
+			Err: "no string 2",
+		},
+		"negative string index": {
+			Input: header + `{"Command":{"Start":0,"Finish":1,"RecipeTarget":-1,"Args":0,"ExitCode":0}}`,
+			Err:   "no string -1",
+		},
+		"string index in a list": {
+			Input: header + `{"Strings":["sh"],"Lists":[[1,2]]}`,
+			Err:   "no string 2",
+		},
+		"list index": {
+			Input: header +
+				`{"Strings":["sh"],"Lists":[[1]]}` + "\n" +
+				`{"Command":{"Start":0,"Finish":1,"Args":2,"ExitCode":0}}`,
+			Err: "no list 2",
+		},
+		"too many sub-commands": {
+			Input: header +
+				`{"Command":{"Start":0,"Finish":1,"Args":0,"ExitCode":0}}` + "\n" +
+				`{"Command":{"Start":0,"Finish":1,"Args":0,"ExitCode":0,"SubCommands":2}}`,
+			Err: "command has 2 sub-commands, but only 1 came before it",
+		},
+		"negative sub-commands": {
+			Input: header + `{"Command":{"Start":0,"Finish":1,"Args":0,"ExitCode":0,"SubCommands":-1}}`,
+			Err:   "command has -1 sub-commands",
+		},
+	}
+	for name, tc := range testcases {
+		var profile Profile
+		err := NewDecoder(strings.NewReader(tc.Input)).Decode(&profile)
+		if err == nil || !strings.Contains(err.Error(), tc.Err) {
+			t.Errorf("%s: got err=%v, want an error containing %q", name, err, tc.Err)
+		}
+	}
+}
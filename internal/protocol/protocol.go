@@ -5,17 +5,41 @@ package protocol
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Profile struct {
-	StartTime  time.Time
-	FinishTime time.Time
-	Commands   []ProfiledCommand
+	StartTime   time.Time
+	FinishTime  time.Time
+	Interrupted bool   // the build was interrupted by a signal; see ProfiledCommand.Unfinished
+	MakeVersion string // such as "GNU Make 4.3"; empty in profiles from older versions
+	OutputSync  string // the top-level make's --output-sync mode; see ProfiledCommand.MakeOutputSync
+	NumCPU      int    // how many CPUs the build could use; 0 in profiles from older versions
+	Commands    []ProfiledCommand
+	Samples     []Sample // only recorded by `run --sample-interval`
+}
+
+// A Sample is a reading of the whole machine's resource usage, taken periodically during the
+// build.  The CPU and disk figures are averages over the time since the previous sample.
+type Sample struct {
+	Time time.Time
+
+	LoadAvg float64 // 1-minute load average
+	CPUBusy float64 // fraction of the time that the CPUs were busy, from 0 to 1
+
+	MemTotal     uint64 // bytes
+	MemAvailable uint64 // bytes
+	SwapTotal    uint64 // bytes
+	SwapFree     uint64 // bytes
+
+	DiskRead    uint64 // bytes per second read from block devices
+	DiskWritten uint64 // bytes per second written to block devices
 }
 
 type ProfiledCommand struct {
@@ -25,16 +49,63 @@ type ProfiledCommand struct {
 	MakeLevel    uint
 	MakeRestarts uint
 	MakeDir      string
+	// MakeOutputSync is the make's --output-sync mode ("none", "line", "target", or "recurse"),
+	// or "" if output-sync is off.
+	MakeOutputSync string
 
-	RecipeTarget       string
-	RecipeDependencies []string
+	RecipeTarget                string
+	RecipeSource                string // "FILE:LINE" of the rule; only set by `run --source-locations`
+	RecipeDependencies          []string
+	RecipeOrderOnlyDependencies []string // $|
+	RecipeNewerDependencies     []string // $?
+	RecipeTargetExisted         *bool    // nil if unknown (profiles from older versions)
+
+	// Shim is whether the command was run by a `run --shim` wrapper, rather than by make as
+	// SHELL.  For a shim, MakeDir is the working directory, and the Recipe fields are empty.
+	Shim bool
+	// MergedProfile is whether the command is one that `profile-make merge` made up to hold one
+	// of the profiles that it merged; it didn't run.  Its RecipeTarget is the profile's label,
+	// and its SubCommands are the profile's commands.
+	MergedProfile bool
 
 	Args         []string
-	ProcessState *os.ProcessState
+	ProcessState *os.ProcessState // doesn't survive JSON encoding; use the fields below instead
+	ExitCode     int              // -1 if the command was killed by a signal or couldn't be started
+	UserTime     time.Duration
+	SystemTime   time.Duration
+	TimedOut     bool // killed by `run --recipe-timeout`
+	// Unfinished is whether the command was still running when an interrupted build's profile
+	// was written; FinishTime is when that was.
+	Unfinished bool
 
 	SubCommands []ProfiledCommand
 }
 
+// Why describes why make ran the command's recipe.  rel is used to shorten filenames for display.
+// It returns "" if the profile doesn't say.
+func (cmd *ProfiledCommand) Why(rel func(string) string) string {
+	if cmd.RecipeTarget == "" || cmd.RecipeTargetExisted == nil {
+		return ""
+	}
+	if !*cmd.RecipeTargetExisted {
+		// Make doesn't say which targets are phony, and phony targets usually have no file.
+		return "the target file was absent (missing or phony)"
+	}
+	if len(cmd.RecipeNewerDependencies) == 0 {
+		return "no prerequisite was newer than the target (it is phony, or was forced)"
+	}
+	const max = 5
+	names := make([]string, 0, max+1)
+	for i, dep := range cmd.RecipeNewerDependencies {
+		if i == max {
+			names = append(names, fmt.Sprintf("and %d more", len(cmd.RecipeNewerDependencies)-max))
+			break
+		}
+		names = append(names, rel(dep))
+	}
+	return "newer prerequisites: " + strings.Join(names, ", ")
+}
+
 type Listener interface {
 	net.Listener
 	SetDeadline(time.Time) error
@@ -46,9 +117,21 @@ type Logger interface {
 
 type server struct {
 	log Logger
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+}
+
+// abandon gives up on the connections that are still open; their commands are still running.
+func (srv *server) abandon() {
+	srv.connsLock.Lock()
+	defer srv.connsLock.Unlock()
+	for conn := range srv.conns {
+		conn.SetReadDeadline(time.Now())
+	}
 }
 
-func (srv server) master(listener net.Listener, cmds chan<- ProfiledCommand) error {
+func (srv *server) master(listener net.Listener, cmds chan<- ProfiledCommand) error {
 	var workers sync.WaitGroup
 	var tempDelay time.Duration
 
@@ -78,17 +161,30 @@ func (srv server) master(listener net.Listener, cmds chan<- ProfiledCommand) err
 			}
 			return err
 		}
+		srv.connsLock.Lock()
+		srv.conns[conn] = struct{}{}
+		srv.connsLock.Unlock()
 		workers.Add(1)
 		go func(conn net.Conn) {
 			defer workers.Done()
+			defer func() {
+				srv.connsLock.Lock()
+				delete(srv.conns, conn)
+				srv.connsLock.Unlock()
+			}()
 			srv.worker(conn, cmds)
 		}(conn)
 	}
 }
 
-func (srv server) worker(conn net.Conn, cmds chan<- ProfiledCommand) {
+func (srv *server) worker(conn net.Conn, cmds chan<- ProfiledCommand) {
+	defer conn.Close()
 	bs, err := ioutil.ReadAll(conn)
 	if err != nil {
+		if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+			// abandoned
+			return
+		}
 		srv.log.Printf("Connection i/o error: %v", err)
 		return
 	}
@@ -101,7 +197,10 @@ func (srv server) worker(conn net.Conn, cmds chan<- ProfiledCommand) {
 	cmds <- cmd
 }
 
-func RunServer(ctx context.Context, listener Listener, log Logger) ([]ProfiledCommand, error) {
+// RunServer collects the commands that are reported to the listener until the context is
+// canceled.  Once it is canceled, RunServer waits for the commands that are still running to
+// report, unless abandon gets closed.
+func RunServer(ctx context.Context, listener Listener, log Logger, abandon <-chan struct{}) ([]ProfiledCommand, error) {
 	cmdChan := make(chan ProfiledCommand)
 
 	var cmdsLock sync.Mutex
@@ -114,9 +213,12 @@ func RunServer(ctx context.Context, listener Listener, log Logger) ([]ProfiledCo
 		}
 	}()
 
+	srv := &server{
+		log:   log,
+		conns: make(map[net.Conn]struct{}),
+	}
 	errChan := make(chan error)
 	go func() {
-		srv := &server{log: log}
 		errChan <- srv.master(listener, cmdChan)
 		close(cmdChan)
 	}()
@@ -125,14 +227,30 @@ func RunServer(ctx context.Context, listener Listener, log Logger) ([]ProfiledCo
 	select {
 	case <-ctx.Done():
 		listener.SetDeadline(time.Now())
-		returnErr = <-errChan
+		select {
+		case returnErr = <-errChan:
+		case <-abandon:
+			srv.abandon()
+			returnErr = <-errChan
+		}
 	case returnErr = <-errChan:
 	}
 	cmdsLock.Lock()
 	return cmds, returnErr
 }
 
+// WithServer runs fn while listening for commands to be reported on listenerName, and returns
+// the reported commands once they have all finished.
 func WithServer(listenerName string, log Logger, fn func()) ([]ProfiledCommand, error) {
+	return WithServerDrain(listenerName, log, func() time.Duration {
+		fn()
+		return 0
+	})
+}
+
+// WithServerDrain is like WithServer, but fn returns how long to wait for commands that are still
+// running when it returns (0 to wait for as long as it takes).
+func WithServerDrain(listenerName string, log Logger, fn func() time.Duration) ([]ProfiledCommand, error) {
 	listener, err := net.Listen("unix", listenerName)
 	if err != nil {
 		return nil, err
@@ -146,16 +264,21 @@ func WithServer(listenerName string, log Logger, fn func()) ([]ProfiledCommand,
 	serverLock.Lock()
 	var serverErr error
 	var serverCmds []ProfiledCommand
+	abandon := make(chan struct{})
 	go func() {
 		defer serverLock.Unlock()
-		serverCmds, serverErr = RunServer(serverCtx, listener.(Listener), log)
+		serverCmds, serverErr = RunServer(serverCtx, listener.(Listener), log, abandon)
 	}()
 
 	// run the function
-	fn()
+	drain := fn()
 
 	// shut down the server
 	serverCancel()
+	if drain > 0 {
+		timer := time.AfterFunc(drain, func() { close(abandon) })
+		defer timer.Stop()
+	}
 	serverLock.Lock()
 
 	// return the results
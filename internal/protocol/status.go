@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"time"
+)
+
+// The status socket is a side-channel for finding out what is running *right now*; the main socket
+// only hears about a command once it has finished.
+
+const (
+	// StatusSocketEnv is the environment variable that the status socket's path is in.
+	StatusSocketEnv = "PROFILE_MAKE_STATUS"
+	// StatusParentEnv is the environment variable that runshell puts its ID in for its
+	// command, so that the commands that that command runs can say who their parent is.
+	StatusParentEnv = "PROFILE_MAKE_PARENT"
+	// MakeLevelEnv is the environment variable that runshell puts its command's make level in,
+	// for the shims that the command runs to pass along, since they aren't run by make.
+	MakeLevelEnv = "PROFILE_MAKE_LEVEL"
+	// OwnProcessGroupEnv, if set, tells runshell to run its command in its own process group,
+	// so that the whole thing can be killed if it times out.
+	OwnProcessGroupEnv = "PROFILE_MAKE_PGRP"
+)
+
+// RunningCommand is what runshell sends over the status socket when its command starts.  The
+// connection stays open until the command finishes.
+type RunningCommand struct {
+	ID       int // runshell's PID
+	ParentID int // the ID of the command that this one is running inside of, or 0
+
+	StartTime time.Time
+
+	MakeLevel    uint
+	MakeDir      string
+	RecipeTarget string
+	Shim         bool
+
+	Args []string
+}
+
+// StatusReply is what may be sent back to runshell over the status socket.
+type StatusReply struct {
+	// TimedOut tells runshell to kill its command, and to record it as timed out.
+	TimedOut bool
+}
@@ -0,0 +1,127 @@
+package report
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+// reports maps the name of each report to the function that implements it.  Each one reads a
+// profile from stdin and writes a report to stdout.
+var reports = map[string]func(args ...string) error{
+	"efficiency": efficiencyMain,
+	"gaps":       gapsMain,
+	"tools":      toolsMain,
+	"why":        whyMain,
+}
+
+func reportNames() []string {
+	names := make([]string, 0, len(reports))
+	for name := range reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Main(args ...string) error {
+	if len(args) == 0 {
+		return errors.Errorf("expected a report name; one of [%s]", strings.Join(reportNames(), " "))
+	}
+	fn, ok := reports[args[0]]
+	if !ok {
+		return errors.Errorf("unrecognized report: %q; expected one of [%s]", args[0], strings.Join(reportNames(), " "))
+	}
+	return fn(args[1:]...)
+}
+
+func readProfile() (protocol.Profile, error) {
+	return protocol.ReadProfile(os.Stdin)
+}
+
+// walkCommands calls fn for every command in the profile, including commands in sub-makes.  The
+// commands that `profile-make merge` made up to hold each merged profile didn't run, so fn is only
+// called for the commands in them.
+func walkCommands(cmds []protocol.ProfiledCommand, fn func(*protocol.ProfiledCommand)) {
+	for i := range cmds {
+		if !cmds[i].MergedProfile {
+			fn(&cmds[i])
+		}
+		walkCommands(cmds[i].SubCommands, fn)
+	}
+}
+
+// ranMake returns whether the command ran a sub-make (not counting shimmed programs).
+func ranMake(cmd *protocol.ProfiledCommand) bool {
+	for _, sub := range cmd.SubCommands {
+		if !sub.Shim {
+			return true
+		}
+	}
+	return false
+}
+
+func duration(cmd *protocol.ProfiledCommand) time.Duration {
+	return cmd.FinishTime.Sub(cmd.StartTime)
+}
+
+// selfCPUTime returns the CPU time used by the command, not counting the CPU time used by any
+// commands that it ran that are in the profile (which are included in its rusage).
+func selfCPUTime(cmd *protocol.ProfiledCommand) time.Duration {
+	cpu := cmd.UserTime + cmd.SystemTime
+	for _, sub := range cmd.SubCommands {
+		cpu -= sub.UserTime + sub.SystemTime
+	}
+	if cpu < 0 {
+		cpu = 0
+	}
+	return cpu
+}
+
+// selfWallTime returns the wall time of the command, not counting the time when programs that it
+// ran through `run --shim` wrappers were running; those are counted as commands of their own.
+// Sub-makes' commands are counted in both.
+func selfWallTime(cmd *protocol.ProfiledCommand) time.Duration {
+	var shims []*protocol.ProfiledCommand
+	for i := range cmd.SubCommands {
+		if cmd.SubCommands[i].Shim {
+			shims = append(shims, &cmd.SubCommands[i])
+		}
+	}
+	sort.Slice(shims, func(i, j int) bool {
+		return shims[i].StartTime.Before(shims[j].StartTime)
+	})
+	// Shimmed programs can run in parallel, so subtract the time when any of them was running.
+	wall := duration(cmd)
+	cursor := cmd.StartTime
+	for _, shim := range shims {
+		start, finish := shim.StartTime, shim.FinishTime
+		if start.Before(cursor) {
+			start = cursor
+		}
+		if finish.After(cmd.FinishTime) {
+			finish = cmd.FinishTime
+		}
+		if finish.After(start) {
+			wall -= finish.Sub(start)
+			cursor = finish
+		}
+	}
+	return wall
+}
+
+func fmtDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	default:
+		return d.String()
+	}
+}
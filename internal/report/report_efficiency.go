@@ -0,0 +1,234 @@
+package report
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+
+	"github.com/datawire/profile-make/internal/protocol"
+	"github.com/datawire/profile-make/internal/shellparse"
+)
+
+// An oversubscription is a stretch of the build during which the commands that were running
+// wanted more CPU than there were CPUs.
+type oversubscription struct {
+	Start  time.Time
+	Finish time.Time
+	Demand time.Duration // CPU time wanted; see MeanDemand
+	Peak   float64       // most CPUs wanted at once
+}
+
+func (o *oversubscription) Duration() time.Duration {
+	return o.Finish.Sub(o.Start)
+}
+
+// MeanDemand returns how many CPUs were wanted, on average.
+func (o *oversubscription) MeanDemand() float64 {
+	return float64(o.Demand) / float64(o.Duration())
+}
+
+type threadedRecipe struct {
+	Target  string
+	Program string
+	Wall    time.Duration
+	CPU     time.Duration
+
+	programCPU time.Duration
+}
+
+// Cores returns how many CPUs the recipe kept busy while it was running, on average.
+func (r *threadedRecipe) Cores() float64 {
+	return float64(r.CPU) / float64(r.Wall)
+}
+
+func efficiencyMain(args ...string) error {
+	argparser := pflag.NewFlagSet("report efficiency", pflag.ContinueOnError)
+	var (
+		argCPUs  = argparser.Int("cpus", 0, "How many CPUs the build could use; 0 to use the number recorded in the profile")
+		argLimit = argparser.Int("limit", 20, "Only list this many of the longest oversubscribed periods and most multi-threaded recipes; 0 for no limit")
+	)
+	err := argparser.Parse(args)
+	if err != nil {
+		return err
+	}
+	if argCnt := len(argparser.Args()); argCnt > 0 {
+		return errors.Errorf("got %d positional arguments; the efficiency report doesn't take positional arguments", argCnt)
+	}
+	if *argCPUs < 0 {
+		return errors.Errorf("invalid --cpus: %d", *argCPUs)
+	}
+
+	profile, err := readProfile()
+	if err != nil {
+		return err
+	}
+	cpus := *argCPUs
+	if cpus == 0 {
+		cpus = profile.NumCPU
+	}
+	if cpus == 0 {
+		return errors.New("the profile doesn't say how many CPUs the build could use (it is from an older version " +
+			"of profile-make, or merges profiles from different machines); use --cpus to say")
+	}
+	var topDir string
+	if len(profile.Commands) > 0 {
+		topDir = profile.Commands[0].MakeDir
+	}
+	rel := func(filename string) string {
+		if r, err := filepath.Rel(topDir, filename); err == nil {
+			return r
+		}
+		return filename
+	}
+
+	// Each command's own CPU time, spread evenly over the time that it ran, is its CPU
+	// demand; that's the best that can be done with only the rusage of each process.
+	type event struct {
+		Time  time.Time
+		Delta float64
+	}
+	var events []event
+	var totalCPU time.Duration
+	recipes := make(map[string]*threadedRecipe)
+	walkCommands(profile.Commands, func(cmd *protocol.ProfiledCommand) {
+		cpu := selfCPUTime(cmd)
+		totalCPU += cpu
+		if wall := duration(cmd); wall > 0 && cpu > 0 {
+			rate := float64(cpu) / float64(wall)
+			events = append(events, event{cmd.StartTime, rate}, event{cmd.FinishTime, -rate})
+		}
+
+		// A recipe's commands each take one job slot, along with any programs that they
+		// ran through `run --shim` wrappers; but commands that ran a sub-make hand their
+		// job slot to it, and parse-time commands don't take one at all.
+		if cmd.Shim || cmd.RecipeTarget == "" || ranMake(cmd) {
+			return
+		}
+		recipe := recipes[cmd.RecipeTarget]
+		if recipe == nil {
+			recipe = &threadedRecipe{Target: cmd.RecipeTarget}
+			recipes[cmd.RecipeTarget] = recipe
+		}
+		cmdCPU := cmd.UserTime + cmd.SystemTime
+		recipe.Wall += duration(cmd)
+		recipe.CPU += cmdCPU
+		if recipe.Program == "" || cmdCPU > recipe.programCPU {
+			recipe.Program = shellparse.ParseArgs(cmd.Args).Program()
+			recipe.programCPU = cmdCPU
+		}
+	})
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+
+	var periods []*oversubscription
+	var open *oversubscription
+	var demand float64
+	last := profile.StartTime
+	for _, ev := range events {
+		if ev.Time.After(last) {
+			if demand > float64(cpus) {
+				if open == nil {
+					open = &oversubscription{Start: last}
+					periods = append(periods, open)
+				}
+				open.Finish = ev.Time
+				open.Demand += time.Duration(demand * float64(ev.Time.Sub(last)))
+				if demand > open.Peak {
+					open.Peak = demand
+				}
+			} else {
+				open = nil
+			}
+			last = ev.Time
+		}
+		demand += ev.Delta
+	}
+	var oversubscribed time.Duration
+	for _, o := range periods {
+		oversubscribed += o.Duration()
+	}
+	sort.SliceStable(periods, func(i, j int) bool {
+		if periods[i].Duration() != periods[j].Duration() {
+			return periods[i].Duration() > periods[j].Duration()
+		}
+		return periods[i].Start.Before(periods[j].Start)
+	})
+
+	var threaded []*threadedRecipe
+	for _, recipe := range recipes {
+		if recipe.CPU > recipe.Wall {
+			threaded = append(threaded, recipe)
+		}
+	}
+	sort.Slice(threaded, func(i, j int) bool {
+		// the ones that used the most CPU beyond their one job slot first
+		extraI := threaded[i].CPU - threaded[i].Wall
+		extraJ := threaded[j].CPU - threaded[j].Wall
+		if extraI != extraJ {
+			return extraI > extraJ
+		}
+		return threaded[i].Target < threaded[j].Target
+	})
+
+	buildDuration := profile.FinishTime.Sub(profile.StartTime)
+	available := time.Duration(cpus) * buildDuration
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "The build took %s on %d CPUs, so there was %s of CPU time available.\n",
+		fmtDuration(buildDuration), cpus, fmtDuration(available))
+	fmt.Fprintf(w, "Commands used %s of it, keeping %.1f CPUs busy on average: %.0f%% parallel efficiency.\n\n",
+		fmtDuration(totalCPU), float64(totalCPU)/float64(buildDuration), 100*float64(totalCPU)/float64(available))
+
+	if len(periods) == 0 {
+		fmt.Fprintf(w, "The commands never wanted more than %d CPUs at once.\n\n", cpus)
+	} else {
+		fmt.Fprintf(w, "The commands wanted more than %d CPUs at once for %s (%.0f%% of the build):\n\n",
+			cpus, fmtDuration(oversubscribed), 100*float64(oversubscribed)/float64(buildDuration))
+		fmt.Fprintln(w, "START\tDURATION\tMEAN CPUS WANTED\tPEAK CPUS WANTED\t")
+		for i, o := range periods {
+			if *argLimit > 0 && i == *argLimit {
+				fmt.Fprintf(w, "(%d more)\t\t\t\t\n", len(periods)-i)
+				break
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t\n",
+				fmtDuration(o.Start.Sub(profile.StartTime)),
+				fmtDuration(o.Duration()),
+				o.MeanDemand(),
+				o.Peak)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(threaded) == 0 {
+		fmt.Fprintln(w, "No recipes used more CPU time than wall time.")
+	} else {
+		fmt.Fprintf(w, "%d recipes used more CPU time than wall time; they are multi-threaded, or run programs in parallel:\n\n",
+			len(threaded))
+		fmt.Fprintln(w, "TARGET\tPROGRAM\tWALL\tCPU\tCPUS\t")
+		for i, recipe := range threaded {
+			if *argLimit > 0 && i == *argLimit {
+				fmt.Fprintf(w, "(%d more)\t\t\t\t\t\n", len(threaded)-i)
+				break
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f\t\n",
+				rel(recipe.Target),
+				recipe.Program,
+				fmtDuration(recipe.Wall),
+				fmtDuration(recipe.CPU),
+				recipe.Cores())
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Println("CPUs wanted assumes that each command used its CPU time evenly over the time that it ran.")
+	fmt.Println("Each recipe takes one of make's -j job slots, however many CPUs it keeps busy.")
+	return nil
+}
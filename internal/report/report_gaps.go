@@ -0,0 +1,367 @@
+package report
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+
+	"github.com/datawire/profile-make/internal/protocol"
+	"github.com/datawire/profile-make/internal/shellparse"
+)
+
+// A gap is a stretch of the build during which fewer than the threshold number of commands were
+// running.
+type gap struct {
+	Start    time.Time
+	Finish   time.Time
+	Running  time.Duration // the sum over time of how many commands were running; see Parallelism
+	Culprits map[string]time.Duration
+}
+
+func (g *gap) Duration() time.Duration {
+	return g.Finish.Sub(g.Start)
+}
+
+// Parallelism returns how many commands were running during the gap, on average.
+func (g *gap) Parallelism() float64 {
+	return float64(g.Running) / float64(g.Duration())
+}
+
+// SortedCulprits returns the gap's culprits, the ones that were running for most of it first.
+func (g *gap) SortedCulprits() []string {
+	list := make([]string, 0, len(g.Culprits))
+	for culprit := range g.Culprits {
+		list = append(list, culprit)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if g.Culprits[list[i]] != g.Culprits[list[j]] {
+			return g.Culprits[list[i]] > g.Culprits[list[j]]
+		}
+		return list[i] < list[j]
+	})
+	return list
+}
+
+// maxGapCulprits is how many culprits to name for each gap.
+const maxGapCulprits = 3
+
+type gapCulprit struct {
+	Culprit string
+	Gaps    int
+	Time    time.Duration
+}
+
+// A gapMake is a make process: the top-level make, or a sub-make that a command ran.  In a merged
+// profile, the top level holds the merged profiles, and each of those is a gapMake of its own.
+type gapMake struct {
+	Start    time.Time
+	Finish   time.Time
+	Commands []*protocol.ProfiledCommand // sorted by start time
+	SubMakes []*gapMake
+}
+
+func newGapMake(start, finish time.Time, cmds []protocol.ProfiledCommand, leaves *[]*protocol.ProfiledCommand) *gapMake {
+	m := &gapMake{Start: start, Finish: finish}
+	for i := range cmds {
+		cmd := &cmds[i]
+		if cmd.Shim {
+			// it ran inside of the command that ran the shim
+			continue
+		}
+		m.Commands = append(m.Commands, cmd)
+		if ranMake(cmd) || cmd.MergedProfile {
+			m.SubMakes = append(m.SubMakes, newGapMake(cmd.StartTime, cmd.FinishTime, cmd.SubCommands, leaves))
+		} else {
+			*leaves = append(*leaves, cmd)
+		}
+	}
+	sort.SliceStable(m.Commands, func(i, j int) bool {
+		return m.Commands[i].StartTime.Before(m.Commands[j].StartTime)
+	})
+	return m
+}
+
+// idle returns the makes that were running between start and finish without a command of their
+// own running; the makes that were parsing, restarting, or just deciding what to do next.  The
+// caller has already checked that no commands that didn't run a sub-make were running.
+func (m *gapMake) idle(start, finish time.Time) []*gapMake {
+	if !m.Start.Before(finish) || !m.Finish.After(start) {
+		return nil
+	}
+	var ret []*gapMake
+	for _, sub := range m.SubMakes {
+		ret = append(ret, sub.idle(start, finish)...)
+	}
+	if len(ret) == 0 {
+		ret = []*gapMake{m}
+	}
+	return ret
+}
+
+// doing describes what the make was doing between start and finish, when it had no commands
+// running.
+func (m *gapMake) doing(start, finish time.Time, rel func(string) string) string {
+	next := sort.Search(len(m.Commands), func(i int) bool {
+		return !m.Commands[i].StartTime.Before(finish)
+	})
+	if next == len(m.Commands) {
+		if len(m.Commands) == 0 {
+			return "make"
+		}
+		if m.Commands[len(m.Commands)-1].MergedProfile {
+			return "nothing (between merged profiles)"
+		}
+		return fmt.Sprintf("make in %s, after its last command", rel(m.Commands[len(m.Commands)-1].MakeDir))
+	}
+	cmd := m.Commands[next]
+	if cmd.MergedProfile {
+		return "nothing (between merged profiles)"
+	}
+	dir := rel(cmd.MakeDir)
+	restarted := cmd.MakeRestarts > 0
+	for _, prev := range m.Commands[:next] {
+		if prev.MakeRestarts == cmd.MakeRestarts {
+			restarted = false
+			break
+		}
+	}
+	switch {
+	case restarted:
+		return fmt.Sprintf("make restart in %s (restart %d)", dir, cmd.MakeRestarts)
+	case next == 0:
+		return fmt.Sprintf("make parsing in %s", dir)
+	default:
+		return fmt.Sprintf("make in %s, between commands", dir)
+	}
+}
+
+func gapsMain(args ...string) error {
+	argparser := pflag.NewFlagSet("report gaps", pflag.ContinueOnError)
+	var (
+		argThreshold = argparser.Int("threshold", 0, "Report periods when fewer than this many commands were running; 0 for half of the most that ever ran at once")
+		argLimit     = argparser.Int("limit", 20, "Only list this many of the longest gaps and worst culprits; 0 for no limit")
+	)
+	err := argparser.Parse(args)
+	if err != nil {
+		return err
+	}
+	if argCnt := len(argparser.Args()); argCnt > 0 {
+		return errors.Errorf("got %d positional arguments; the gaps report doesn't take positional arguments", argCnt)
+	}
+	if *argThreshold < 0 {
+		return errors.Errorf("invalid --threshold: %d", *argThreshold)
+	}
+
+	profile, err := readProfile()
+	if err != nil {
+		return err
+	}
+	var topDir string
+	if len(profile.Commands) > 0 {
+		topDir = profile.Commands[0].MakeDir
+	}
+	rel := func(filename string) string {
+		if r, err := filepath.Rel(topDir, filename); err == nil {
+			return r
+		}
+		return filename
+	}
+
+	// Parallelism counts the commands that hold a job slot: the ones that didn't run a
+	// sub-make.  (A sub-make's commands are counted instead of the $(MAKE) command.)
+	var leaves []*protocol.ProfiledCommand
+	top := newGapMake(profile.StartTime, profile.FinishTime, profile.Commands, &leaves)
+	if len(leaves) == 0 {
+		fmt.Println("No commands ran.")
+		return nil
+	}
+
+	type event struct {
+		Time  time.Time
+		Delta int
+		Cmd   *protocol.ProfiledCommand // nil for a sub-make starting or finishing
+	}
+	events := make([]event, 0, 2*len(leaves))
+	var end time.Time // when the last command finished
+	for _, cmd := range leaves {
+		events = append(events, event{cmd.StartTime, 1, cmd}, event{cmd.FinishTime, -1, cmd})
+		if cmd.FinishTime.After(end) {
+			end = cmd.FinishTime
+		}
+	}
+	// Sub-makes starting and finishing don't change how many commands are running, but they
+	// do change which make is to blame when none are.
+	var addMakeEvents func(m *gapMake)
+	addMakeEvents = func(m *gapMake) {
+		for _, sub := range m.SubMakes {
+			events = append(events, event{sub.Start, 0, nil}, event{sub.Finish, 0, nil})
+			addMakeEvents(sub)
+		}
+	}
+	addMakeEvents(top)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+
+	peak, cur := 0, 0
+	for _, ev := range events {
+		cur += ev.Delta
+		if cur > peak {
+			peak = cur
+		}
+	}
+	threshold := *argThreshold
+	if threshold == 0 {
+		if peak < 2 {
+			fmt.Println("The build never ran more than one command at a time, so it was serialized throughout;")
+			fmt.Println("was make run with -j?")
+			return nil
+		}
+		threshold = (peak + 1) / 2
+	}
+
+	// culprit names the recipe that a command was part of, and the program that it ran.
+	culprits := make(map[*protocol.ProfiledCommand]string)
+	culprit := func(cmd *protocol.ProfiledCommand) string {
+		if name, ok := culprits[cmd]; ok {
+			return name
+		}
+		program := shellparse.ParseArgs(cmd.Args).Program()
+		if cmd.RecipeTarget == "" {
+			culprits[cmd] = fmt.Sprintf("$(shell %s ...) while parsing %s", program, rel(cmd.MakeDir))
+		} else {
+			culprits[cmd] = fmt.Sprintf("%s (%s)", rel(cmd.RecipeTarget), program)
+		}
+		return culprits[cmd]
+	}
+
+	// Sweep through the build, from its start until the last command finished (after that,
+	// there was no work left), keeping track of which commands were running.
+	var gaps []*gap
+	var open *gap
+	running := make(map[*protocol.ProfiledCommand]struct{})
+	last := profile.StartTime
+	step := func(until time.Time) {
+		if !until.After(last) {
+			return
+		}
+		dt := until.Sub(last)
+		if len(running) >= threshold {
+			open = nil
+			last = until
+			return
+		}
+		if open == nil {
+			open = &gap{Start: last, Culprits: make(map[string]time.Duration)}
+			gaps = append(gaps, open)
+		}
+		open.Finish = until
+		open.Running += dt * time.Duration(len(running))
+		if len(running) == 0 {
+			for _, m := range top.idle(last, until) {
+				open.Culprits[m.doing(last, until, rel)] += dt
+			}
+		}
+		for cmd := range running {
+			open.Culprits[culprit(cmd)] += dt
+		}
+		last = until
+	}
+	for _, ev := range events {
+		if ev.Time.After(end) {
+			break
+		}
+		step(ev.Time)
+		switch {
+		case ev.Delta > 0:
+			running[ev.Cmd] = struct{}{}
+		case ev.Delta < 0:
+			delete(running, ev.Cmd)
+		}
+	}
+
+	var total time.Duration
+	byCulprit := make(map[string]*gapCulprit)
+	for _, g := range gaps {
+		total += g.Duration()
+		for name, overlap := range g.Culprits {
+			if byCulprit[name] == nil {
+				byCulprit[name] = &gapCulprit{Culprit: name}
+			}
+			byCulprit[name].Gaps++
+			byCulprit[name].Time += overlap
+		}
+	}
+	sort.SliceStable(gaps, func(i, j int) bool {
+		if gaps[i].Duration() != gaps[j].Duration() {
+			return gaps[i].Duration() > gaps[j].Duration()
+		}
+		return gaps[i].Start.Before(gaps[j].Start)
+	})
+	culpritList := make([]*gapCulprit, 0, len(byCulprit))
+	for _, c := range byCulprit {
+		culpritList = append(culpritList, c)
+	}
+	sort.Slice(culpritList, func(i, j int) bool {
+		if culpritList[i].Time != culpritList[j].Time {
+			return culpritList[i].Time > culpritList[j].Time
+		}
+		return culpritList[i].Culprit < culpritList[j].Culprit
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	buildDuration := profile.FinishTime.Sub(profile.StartTime)
+	fmt.Fprintf(w, "The most commands that ran at once was %d; looking for periods with fewer than %d running.\n", peak, threshold)
+	if len(gaps) == 0 {
+		fmt.Fprintln(w, "There were none.")
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "Found %d gaps, totaling %s (%.0f%% of the build).\n\n",
+		len(gaps), fmtDuration(total), 100*float64(total)/float64(buildDuration))
+	fmt.Fprintln(w, "START\tDURATION\tRUNNING\tWAITING ON\t")
+	for i, g := range gaps {
+		if *argLimit > 0 && i == *argLimit {
+			fmt.Fprintf(w, "(%d more)\t\t\t\t\n", len(gaps)-i)
+			break
+		}
+		// Name the culprits that were running for at least half of the gap (up to a few of
+		// them); or if none were, the one that was running for the longest.
+		culprits := g.SortedCulprits()
+		n := 1
+		for n < len(culprits) && n < maxGapCulprits && 2*g.Culprits[culprits[n]] >= g.Duration() {
+			n++
+		}
+		waitingOn := strings.Join(culprits[:n], ", ")
+		if more := len(culprits) - n; more > 0 {
+			waitingOn += fmt.Sprintf(" (and %d more)", more)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%s\t\n",
+			fmtDuration(g.Start.Sub(profile.StartTime)),
+			fmtDuration(g.Duration()),
+			g.Parallelism(),
+			waitingOn)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CULPRIT\tGAPS\tTIME\t")
+	for i, c := range culpritList {
+		if *argLimit > 0 && i == *argLimit {
+			fmt.Fprintf(w, "(%d more)\t\t\t\n", len(culpritList)-i)
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t\n", c.Culprit, c.Gaps, fmtDuration(c.Time))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Println("TIME is how long the culprit was running (or, for make itself, running no commands)")
+	fmt.Println("during the gaps.")
+	return nil
+}
@@ -0,0 +1,112 @@
+package report
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+
+	"github.com/datawire/profile-make/internal/protocol"
+	"github.com/datawire/profile-make/internal/shellparse"
+)
+
+type toolStats struct {
+	Tool  string
+	Count int
+	Wall  time.Duration
+	CPU   time.Duration
+}
+
+// shimmedItself returns whether the command's own program ran through a `run --shim` wrapper (as
+// when a recipe is just `go build`, and go is shimmed); then the shimmed sub-command is the same
+// invocation of the program, and is what gets counted.
+func shimmedItself(cmd *protocol.ProfiledCommand, tool string) bool {
+	for _, sub := range cmd.SubCommands {
+		if sub.Shim && shellparse.ParseArgs(sub.Args).Program() == tool {
+			return true
+		}
+	}
+	return false
+}
+
+func toolsMain(args ...string) error {
+	argparser := pflag.NewFlagSet("report tools", pflag.ContinueOnError)
+	var (
+		argSort = argparser.String("sort", "wall", "Column to sort by; one of [wall cpu count]")
+	)
+	err := argparser.Parse(args)
+	if err != nil {
+		return err
+	}
+	if argCnt := len(argparser.Args()); argCnt > 0 {
+		return errors.Errorf("got %d positional arguments; the tools report doesn't take positional arguments", argCnt)
+	}
+	var less func(a, b *toolStats) bool
+	switch *argSort {
+	case "wall":
+		less = func(a, b *toolStats) bool { return a.Wall > b.Wall }
+	case "cpu":
+		less = func(a, b *toolStats) bool { return a.CPU > b.CPU }
+	case "count":
+		less = func(a, b *toolStats) bool { return a.Count > b.Count }
+	default:
+		return errors.Errorf("invalid --sort: %q", *argSort)
+	}
+
+	profile, err := readProfile()
+	if err != nil {
+		return err
+	}
+
+	byTool := make(map[string]*toolStats)
+	var total toolStats
+	walkCommands(profile.Commands, func(cmd *protocol.ProfiledCommand) {
+		tool := shellparse.ParseArgs(cmd.Args).Program()
+		if byTool[tool] == nil {
+			byTool[tool] = &toolStats{Tool: tool}
+		}
+		stats := byTool[tool]
+		if !shimmedItself(cmd, tool) {
+			stats.Count++
+			total.Count++
+		}
+		stats.Wall += selfWallTime(cmd)
+		stats.CPU += selfCPUTime(cmd)
+		total.CPU += selfCPUTime(cmd)
+	})
+	list := make([]*toolStats, 0, len(byTool))
+	for _, stats := range byTool {
+		list = append(list, stats)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if less(list[i], list[j]) != less(list[j], list[i]) {
+			return less(list[i], list[j])
+		}
+		return list[i].Tool < list[j].Tool
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROGRAM\tCOUNT\tWALL TOTAL\tWALL MEAN\tCPU TOTAL\tCPU MEAN\t")
+	for _, stats := range list {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t\n",
+			stats.Tool,
+			stats.Count,
+			fmtDuration(stats.Wall),
+			fmtDuration(stats.Wall/time.Duration(stats.Count)),
+			fmtDuration(stats.CPU),
+			fmtDuration(stats.CPU/time.Duration(stats.Count)))
+	}
+	fmt.Fprintf(w, "(total)\t%d\t\t\t%s\t\t\n", total.Count, fmtDuration(total.CPU))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Println("Wall time of a command that runs a sub-make includes the time of the sub-make's commands;")
+	fmt.Println("CPU time does not.  Neither includes programs run through `run --shim` wrappers, which are")
+	fmt.Println("listed as programs of their own.")
+	return nil
+}
@@ -0,0 +1,226 @@
+package report
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+type whyRecipe struct {
+	Input    string // the label of the merged profile that the recipe is in; "" if it isn't merged
+	Target   string
+	Duration time.Duration
+	First    *protocol.ProfiledCommand
+
+	causes   []string
+	visiting bool
+}
+
+// Merged profiles (see `profile-make merge`) may be of different checkouts of the same tree, so
+// recipes are only the same if they are for the same target in the same merged profile.
+type whyKey struct {
+	Input  string
+	Target string
+}
+
+type whyCause struct {
+	Cause    string
+	Count    int
+	Duration time.Duration
+}
+
+func whyMain(args ...string) error {
+	argparser := pflag.NewFlagSet("report why", pflag.ContinueOnError)
+	var (
+		argLimit = argparser.Int("limit", 20, "Only list this many of the slowest recipes and most common causes; 0 for no limit")
+	)
+	err := argparser.Parse(args)
+	if err != nil {
+		return err
+	}
+	if argCnt := len(argparser.Args()); argCnt > 0 {
+		return errors.Errorf("got %d positional arguments; the why report doesn't take positional arguments", argCnt)
+	}
+
+	profile, err := readProfile()
+	if err != nil {
+		return err
+	}
+	var topDir string
+	if len(profile.Commands) > 0 {
+		topDir = profile.Commands[0].MakeDir
+	}
+	rel := func(filename string) string {
+		if r, err := filepath.Rel(topDir, filename); err == nil {
+			return r
+		}
+		return filename
+	}
+	// name names a recipe's target, or a file, for display; in a merged profile, that
+	// includes which of the merged profiles it's from.
+	name := func(input, filename string) string {
+		if input != "" {
+			return input + ": " + rel(filename)
+		}
+		return rel(filename)
+	}
+
+	recipes := make(map[whyKey]*whyRecipe)
+	addRecipes := func(input string, cmds []protocol.ProfiledCommand) {
+		walkCommands(cmds, func(cmd *protocol.ProfiledCommand) {
+			if cmd.RecipeTarget == "" {
+				return
+			}
+			key := whyKey{Input: input, Target: cmd.RecipeTarget}
+			recipe := recipes[key]
+			if recipe == nil {
+				recipe = &whyRecipe{Input: input, Target: cmd.RecipeTarget}
+				recipes[key] = recipe
+			}
+			recipe.Duration += duration(cmd)
+			// Later commands in the recipe may see the target that earlier commands
+			// created, so go by the first one.
+			if recipe.First == nil || cmd.StartTime.Before(recipe.First.StartTime) {
+				recipe.First = cmd
+			}
+		})
+	}
+	for i := range profile.Commands {
+		if cmd := &profile.Commands[i]; cmd.MergedProfile {
+			addRecipes(cmd.RecipeTarget, cmd.SubCommands)
+		} else {
+			addRecipes("", profile.Commands[i:i+1])
+		}
+	}
+
+	// causes returns the root causes that made the recipe run: prerequisites that changed
+	// without being rebuilt, targets whose files were absent (missing, or phony), and targets
+	// that are phony or forced.
+	var causes func(*whyRecipe) []string
+	causes = func(recipe *whyRecipe) []string {
+		if recipe.causes != nil || recipe.visiting {
+			return recipe.causes
+		}
+		recipe.visiting = true
+		defer func() { recipe.visiting = false }()
+		set := make(map[string]struct{})
+		switch {
+		case recipe.First.RecipeTargetExisted == nil:
+			set["(unknown)"] = struct{}{}
+		case !*recipe.First.RecipeTargetExisted:
+			set["absent (missing or phony): "+name(recipe.Input, recipe.Target)] = struct{}{}
+		case len(recipe.First.RecipeNewerDependencies) == 0:
+			set["phony or forced: "+name(recipe.Input, recipe.Target)] = struct{}{}
+		default:
+			for _, dep := range recipe.First.RecipeNewerDependencies {
+				if depRecipe, rebuilt := recipes[whyKey{Input: recipe.Input, Target: dep}]; rebuilt && depRecipe != recipe {
+					for _, cause := range causes(depRecipe) {
+						set[cause] = struct{}{}
+					}
+				} else {
+					set["changed: "+name(recipe.Input, dep)] = struct{}{}
+				}
+			}
+		}
+		recipe.causes = make([]string, 0, len(set))
+		for cause := range set {
+			recipe.causes = append(recipe.causes, cause)
+		}
+		sort.Strings(recipe.causes)
+		return recipe.causes
+	}
+
+	list := make([]*whyRecipe, 0, len(recipes))
+	byCause := make(map[string]*whyCause)
+	for _, recipe := range recipes {
+		list = append(list, recipe)
+		for _, cause := range causes(recipe) {
+			if byCause[cause] == nil {
+				byCause[cause] = &whyCause{Cause: cause}
+			}
+			byCause[cause].Count++
+			byCause[cause].Duration += recipe.Duration
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Duration != list[j].Duration {
+			return list[i].Duration > list[j].Duration
+		}
+		if list[i].Target != list[j].Target {
+			return list[i].Target < list[j].Target
+		}
+		return list[i].Input < list[j].Input
+	})
+	causeList := make([]*whyCause, 0, len(byCause))
+	for _, cause := range byCause {
+		causeList = append(causeList, cause)
+	}
+	sort.Slice(causeList, func(i, j int) bool {
+		if causeList[i].Count != causeList[j].Count {
+			return causeList[i].Count > causeList[j].Count
+		}
+		return causeList[i].Cause < causeList[j].Cause
+	})
+
+	// Only show the RULE column if the profile was recorded with `run --source-locations`.
+	showSource := false
+	for _, recipe := range list {
+		if recipe.First.RecipeSource != "" {
+			showSource = true
+			break
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if profile.Interrupted {
+		fmt.Fprintf(w, "%d recipes ran before the build was interrupted.\n\n", len(list))
+	} else {
+		fmt.Fprintf(w, "%d recipes ran.\n\n", len(list))
+	}
+	if showSource {
+		fmt.Fprintln(w, "TARGET\tDURATION\tRULE\tWHY\t")
+	} else {
+		fmt.Fprintln(w, "TARGET\tDURATION\tWHY\t")
+	}
+	for i, recipe := range list {
+		if *argLimit > 0 && i == *argLimit {
+			fmt.Fprintf(w, "(%d more)\t\t\t\n", len(list)-i)
+			break
+		}
+		why := recipe.First.Why(rel)
+		switch {
+		case why != "":
+		case recipe.First.Unfinished:
+			why = "(unknown; still running when the build was interrupted)"
+		default:
+			why = "(unknown; the profile is from an older version of profile-make)"
+		}
+		if showSource {
+			source := "-"
+			if recipe.First.RecipeSource != "" {
+				source = rel(recipe.First.RecipeSource)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", name(recipe.Input, recipe.Target), fmtDuration(recipe.Duration), source, why)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\t\n", name(recipe.Input, recipe.Target), fmtDuration(recipe.Duration), why)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "ROOT CAUSE\tRECIPES\tDURATION\t")
+	for i, cause := range causeList {
+		if *argLimit > 0 && i == *argLimit {
+			fmt.Fprintf(w, "(%d more)\t\t\t\n", len(causeList)-i)
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t\n", cause.Cause, cause.Count, fmtDuration(cause.Duration))
+	}
+	return w.Flush()
+}
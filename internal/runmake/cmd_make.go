@@ -1,13 +1,16 @@
 package runmake
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -26,13 +29,46 @@ func (stderrLogger) Printf(format string, a ...interface{}) (n int, err error) {
 func Main(args ...string) error {
 	argparser := pflag.NewFlagSet("run", pflag.ContinueOnError)
 	var (
-		argOutputFile = argparser.String("output-file", "", "Filename to write profiler results to")
+		argOutputFile      = argparser.String("output-file", "", "Filename to write profiler results to; gzipped if it ends in \".gz\", or \"-\" for stdout")
+		argSourceLocations = argparser.Bool("source-locations", false, "Record the makefile and line that each recipe came from (runs make with --trace)")
+		argShims           = argparser.StringSlice("shim", nil, "Also profile each run of these programs, wherever in the build they're run from (comma-separated)")
+		argRecipeTimeout   = argparser.Duration("recipe-timeout", 0, "Kill any command that runs for longer than this (not counting time spent waiting on sub-makes); 0 for no limit")
+		argWarnAfter       = argparser.Duration("warn-after", 0, "Warn about commands that have been running for longer than this (not counting time spent waiting on sub-makes); 0 to not warn")
+		argSampleInterval  = argparser.Duration("sample-interval", 0, "Record the machine's load average, CPU utilization, memory, swap and disk I/O this often during the build; 0 to not")
 	)
 	err := argparser.Parse(args)
 	if err != nil {
 		return err
 	}
 	cmdline := argparser.Args()
+	if len(cmdline) == 0 {
+		return errors.New("expected a make command to run")
+	}
+	if *argOutputFile == "" {
+		return errors.New("--output-file is required")
+	}
+
+	// If the profile is going to stdout, then make's output can't.
+	makeStdout := os.Stdout
+	if *argOutputFile == "-" {
+		makeStdout = os.Stderr
+	}
+
+	makeCmd := makeCommand(cmdline)
+	if len(makeCmd) == 0 {
+		return errors.Errorf("expected a make command to run, but %q doesn't run anything", strings.Join(cmdline, " "))
+	}
+	version, err := detectMakeVersion(makeCmd[0])
+	if err != nil {
+		return explainExecError(err, cmdline)
+	}
+	if *argSourceLocations && !version.AtLeast(4, 0) {
+		return errors.Errorf("--source-locations requires GNU Make 4.0 or newer (for --trace), but %q is %s",
+			makeCmd[0], version.String)
+	}
+	if err := checkMakeFeatures(version, makeCmd); err != nil {
+		return err
+	}
 
 	exe, err := os.Executable()
 	if err != nil {
@@ -50,56 +86,223 @@ func Main(args ...string) error {
 	}
 	listenerName := filepath.Join(tmpdir, "socket")
 
+	var shimDir string
+	if len(*argShims) > 0 {
+		shimDir = filepath.Join(tmpdir, "shims")
+		if err := writeShims(shimDir, exe, *argShims); err != nil {
+			return err
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	status := &statusTracker{
+		TopDir:        cwd,
+		RecipeTimeout: *argRecipeTimeout,
+		WarnAfter:     *argWarnAfter,
+	}
+	statusListener, err := net.Listen("unix", filepath.Join(tmpdir, "status"))
+	if err != nil {
+		return err
+	}
+	defer statusListener.Close()
+	go status.Serve(statusListener)
+	statusDone := make(chan struct{})
+	defer close(statusDone)
+	go status.Watch(statusDone)
+
+	var trace *traceFilter
+	if *argSourceLocations {
+		trace = new(traceFilter)
+	}
+
+	var samples *sampler
+	sampleDone := make(chan struct{})
+	sampleFinished := make(chan struct{})
+	if *argSampleInterval > 0 {
+		samples = &sampler{Interval: *argSampleInterval}
+		if err := samples.Start(); err != nil {
+			return err
+		}
+		go func() {
+			defer close(sampleFinished)
+			samples.Run(sampleDone)
+		}()
+	}
+
 	startTime := time.Now()
+
+	// Dump what's running on SIGUSR1 or SIGQUIT, to find out what's stuck.
+	dumpSigs := make(chan os.Signal, 1)
+	signal.Notify(dumpSigs, syscall.SIGUSR1, syscall.SIGQUIT)
+	defer signal.Stop(dumpSigs)
+	go func() {
+		for range dumpSigs {
+			status.Dump(os.Stderr, startTime)
+		}
+	}()
+
+	// Pass ^C and friends along to make, and still write a profile.
+	pg := newProcessGroup()
+	defer pg.Close()
+
 	var cmdErr error
-	cmds, err := protocol.WithServer(listenerName, stderrLogger{}, func() {
+	cmds, err := protocol.WithServerDrain(listenerName, stderrLogger{}, func() time.Duration {
+		defer pg.Close()
 
-		shell := runshell.GetProfilingShell(exe, listenerName)
+		shell := runshell.GetProfilingShell(exe, listenerName, runshell.MakeFeatures{
+			Wait: version.AtLeast(4, 4),
+		})
 
 		cmdline := append(cmdline, "SHELL="+shell)
+		if trace != nil {
+			cmdline = append(cmdline, "--trace")
+		}
 		cmd := exec.Command(cmdline[0], cmdline[1:]...)
 		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), protocol.StatusSocketEnv+"="+statusListener.Addr().String())
+		if *argRecipeTimeout > 0 {
+			cmd.Env = append(cmd.Env, protocol.OwnProcessGroupEnv+"=1")
+		}
+		if shimDir != "" {
+			cmd.Env = append(cmd.Env,
+				shimSocketEnv+"="+listenerName,
+				"PATH="+shimDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+		}
 
-		cmdErr = cmd.Run()
-	})
-	if cmdErr != nil {
-		if _, ok := cmdErr.(*exec.Error); ok {
-			prefix := os.Args[:len(os.Args)-len(cmdline)]
-			suffix := os.Args[len(prefix):]
-			return errors.Errorf("%v\n"+
-				"  You wrote:\n"+
-				"      %s\n"+
-				"  Did you mean to write:\n"+
-				"      %s make %s\n"+
-				"      %*s ^^^^",
-				cmdErr,
-				strings.Join(os.Args, " "),
-				strings.Join(prefix, " "),
-				strings.Join(suffix, " "),
-				len(strings.Join(prefix, " ")), "",
-			)
+		pg.Setup(cmd)
+
+		if trace == nil {
+			cmd.Stdout = makeStdout
+			if cmdErr = cmd.Start(); cmdErr != nil {
+				return 0
+			}
+			stop := pg.Forward(cmd.Process)
+			cmdErr = cmd.Wait()
+			stop()
+			return drainTime(pg, cmdErr)
+		}
+		pipeR, pipeW, err := os.Pipe()
+		if err != nil {
+			cmdErr = err
+			return 0
+		}
+		defer pipeR.Close()
+		cmd.Stdout = pipeW
+		// With --output-sync, make checks whether stdout and stderr are the same file, and if
+		// so collects them together so that each recipe's output stays in the order that it
+		// was written; give it the same pipe for both so that it can keep doing that.
+		if sameFile(makeStdout, os.Stderr) {
+			cmd.Stderr = pipeW
+		}
+		err = cmd.Start()
+		pipeW.Close()
+		if err != nil {
+			cmdErr = err
+			return 0
 		}
+		stop := pg.Forward(cmd.Process)
+		filterErr := trace.Filter(makeStdout, pipeR)
+		cmdErr = cmd.Wait()
+		stop()
+		if cmdErr == nil && filterErr != nil {
+			cmdErr = filterErr
+		}
+		return drainTime(pg, cmdErr)
+	})
+	if _, ok := cmdErr.(*exec.Error); ok {
+		return explainExecError(cmdErr, cmdline)
 	}
 	if err != nil {
 		return err
 	}
+	if samples != nil {
+		close(sampleDone)
+		<-sampleFinished
+	}
 	finishTime := time.Now()
-
-	file, err := os.OpenFile(*argOutputFile, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return err
+	interrupted := pg.Interrupted(cmdErr)
+	if interrupted {
+		cmds = append(cmds, status.Unfinished(finishTime)...)
 	}
-	defer file.Close()
+	if trace != nil {
+		trace.Annotate(cmds)
+	}
+
 	profile := protocol.Profile{
-		StartTime:  startTime,
-		FinishTime: finishTime,
-		Commands:   cmds,
+		StartTime:   startTime,
+		FinishTime:  finishTime,
+		Interrupted: interrupted,
+		MakeVersion: version.String,
+		OutputSync:  outputSync(cmds),
+		NumCPU:      runtime.NumCPU(),
+		Commands:    cmds,
 	}
-	if err := json.NewEncoder(file).Encode(profile); err != nil {
+	if samples != nil {
+		profile.Samples = samples.Samples()
+	}
+	if err := protocol.WriteProfileFile(*argOutputFile, profile); err != nil {
 		return err
 	}
+	if sig := pg.Signal(cmdErr); sig != 0 {
+		pg.Die(sig)
+	}
 
 	return cmdErr
 }
+
+// drainTime is how long to wait for the commands that are still running once make has exited: as
+// long as it takes, unless the build was interrupted.
+func drainTime(pg *processGroup, cmdErr error) time.Duration {
+	if pg.Interrupted(cmdErr) {
+		return interruptGrace
+	}
+	return 0
+}
+
+// explainExecError adds a hint to errors from failing to run the make program, since the most
+// likely cause is that the user forgot to say "make".
+func explainExecError(err error, cmdline []string) error {
+	if _, ok := err.(*exec.Error); !ok {
+		return err
+	}
+	prefix := os.Args[:len(os.Args)-len(cmdline)]
+	suffix := os.Args[len(prefix):]
+	return errors.Errorf("%v\n"+
+		"  You wrote:\n"+
+		"      %s\n"+
+		"  Did you mean to write:\n"+
+		"      %s make %s\n"+
+		"      %*s ^^^^",
+		err,
+		strings.Join(os.Args, " "),
+		strings.Join(prefix, " "),
+		strings.Join(suffix, " "),
+		len(strings.Join(prefix, " ")), "",
+	)
+}
+
+func sameFile(a, b *os.File) bool {
+	aInfo, err := a.Stat()
+	if err != nil {
+		return false
+	}
+	bInfo, err := b.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// outputSync returns the top-level make's --output-sync mode, as reported by its commands.
+func outputSync(cmds []protocol.ProfiledCommand) string {
+	for _, cmd := range cmds {
+		if cmd.MakeLevel == 0 {
+			return cmd.MakeOutputSync
+		}
+	}
+	return ""
+}
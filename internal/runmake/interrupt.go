@@ -0,0 +1,150 @@
+package runmake
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// interruptGrace is how long to wait for the commands that are still running to report once the
+// build has been interrupted, before giving up on them and writing what we have.
+const interruptGrace = 5 * time.Second
+
+// interruptSignals are the signals that get passed along to make, rather than killing us before
+// the profile gets written.
+var interruptSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// processGroup runs make in its own process group, so that signals can be sent to the whole build
+// without also hitting whatever ran profile-make (a script, say).
+type processGroup struct {
+	// foreground is whether make's process group is put in charge of the terminal; if it is,
+	// then ^C goes straight to the build, and the terminal has to be taken back afterward.
+	foreground bool
+
+	sigs   chan os.Signal
+	caught syscall.Signal // the signal that we passed along, if any
+	closed bool
+}
+
+func newProcessGroup() *processGroup {
+	pg := &processGroup{
+		foreground: isForeground(),
+		sigs:       make(chan os.Signal, 1),
+	}
+	signal.Notify(pg.sigs, interruptSignals...)
+	return pg
+}
+
+// Setup must be called on the command before it is started.
+func (pg *processGroup) Setup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Foreground: pg.foreground,
+		Ctty:       0, // stdin
+	}
+}
+
+// Forward starts passing signals along to the process group; it must be called once the command
+// has started.  The returned function stops it.
+func (pg *processGroup) Forward(proc *os.Process) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-pg.sigs:
+				pg.caught = sig.(syscall.Signal)
+				_ = syscall.Kill(-proc.Pid, sig.(syscall.Signal))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Close stops catching signals, and takes the terminal back from make.
+func (pg *processGroup) Close() {
+	if pg.closed {
+		return
+	}
+	pg.closed = true
+	signal.Stop(pg.sigs)
+	if pg.foreground {
+		// We're in the background now, so changing the terminal's foreground process
+		// group would stop us with SIGTTOU.
+		signal.Ignore(syscall.SIGTTOU)
+		defer signal.Reset(syscall.SIGTTOU)
+		pgrp := int32(syscall.Getpgrp())
+		_ = ioctlPgrp(0, syscall.TIOCSPGRP, &pgrp)
+	}
+}
+
+// Signal returns the signal that interrupted the build, either one that we passed along, or one
+// that went straight to make from the terminal; or 0 if the build wasn't interrupted.
+func (pg *processGroup) Signal(cmdErr error) syscall.Signal {
+	if pg.caught != 0 {
+		return pg.caught
+	}
+	if ee, ok := cmdErr.(*exec.ExitError); ok {
+		status := ee.Sys().(syscall.WaitStatus)
+		if status.Signaled() {
+			for _, sig := range interruptSignals {
+				if status.Signal() == sig {
+					return status.Signal()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// Interrupted returns whether the build was interrupted by a signal.
+func (pg *processGroup) Interrupted(cmdErr error) bool {
+	return pg.Signal(cmdErr) != 0
+}
+
+// Die takes the terminal back from make, and kills us with sig, so that whatever ran us sees that
+// we were interrupted, rather than that we exited; a shell only stops running a script on ^C if
+// it got the SIGINT too, and the command that it was waiting for died of it.  Die returns only if
+// sig is being ignored.
+func (pg *processGroup) Die(sig syscall.Signal) {
+	pg.Close()
+	signal.Reset(sig)
+	target := os.Getpid()
+	if pg.foreground && pg.caught == 0 {
+		// The terminal sent sig to make's process group, which we made the foreground one;
+		// send it to the rest of ours too, which it would have gone to otherwise.
+		target = -syscall.Getpgrp()
+	}
+	_ = syscall.Kill(target, sig)
+	// The signal is delivered asynchronously; don't return (and exit) before it gets here.
+	time.Sleep(time.Second)
+}
+
+// isForeground returns whether stdin is a terminal that we're in the foreground of.
+func isForeground() bool {
+	var pgrp int32
+	if err := ioctlPgrp(0, syscall.TIOCGPGRP, &pgrp); err != nil {
+		return false
+	}
+	return int(pgrp) == syscall.Getpgrp()
+}
+
+// ioctlPgrp does a TIOCGPGRP or TIOCSPGRP ioctl.  The pointer has to be converted to a uintptr in
+// the call to Syscall itself, so that the garbage collector keeps pgrp alive (and in place) until
+// the call returns.
+func ioctlPgrp(fd int, req uint, pgrp *int32) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(unsafe.Pointer(pgrp)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
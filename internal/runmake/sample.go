@@ -0,0 +1,170 @@
+package runmake
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+// procCounters are the cumulative counters in /proc that samples are worked out from.
+type procCounters struct {
+	Time     time.Time
+	CPUTotal uint64 // jiffies
+	CPUIdle  uint64 // jiffies, including iowait
+	PgpgIn   uint64 // KiB read from block devices
+	PgpgOut  uint64 // KiB written to block devices
+}
+
+// sampler periodically records the whole machine's resource usage, for `run --sample-interval`.
+type sampler struct {
+	Interval time.Duration
+
+	mu      sync.Mutex
+	prev    procCounters
+	samples []protocol.Sample
+}
+
+// Start takes the first reading, so that the first sample has something to be measured from, and
+// checks that the machine has everything that sampling needs.
+func (s *sampler) Start() error {
+	counters, err := readProcCounters(time.Now())
+	if err != nil {
+		return errors.Wrap(err, "--sample-interval requires Linux's /proc")
+	}
+	s.prev = counters
+	return nil
+}
+
+// Run takes a sample every Interval, until done is closed, and then takes a last one.
+func (s *sampler) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			s.sample(time.Now())
+			return
+		case now := <-ticker.C:
+			s.sample(now)
+		}
+	}
+}
+
+func (s *sampler) sample(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters, err := readProcCounters(now)
+	if err != nil {
+		// a /proc file that could be read a moment ago can't be now; skip this sample
+		return
+	}
+	sample := protocol.Sample{
+		Time: now,
+	}
+	if counters.CPUTotal > s.prev.CPUTotal && counters.CPUIdle >= s.prev.CPUIdle {
+		total := counters.CPUTotal - s.prev.CPUTotal
+		idle := counters.CPUIdle - s.prev.CPUIdle
+		sample.CPUBusy = 1 - float64(idle)/float64(total)
+	}
+	if secs := counters.Time.Sub(s.prev.Time).Seconds(); secs > 0 {
+		if counters.PgpgIn >= s.prev.PgpgIn {
+			sample.DiskRead = uint64(float64(1024*(counters.PgpgIn-s.prev.PgpgIn)) / secs)
+		}
+		if counters.PgpgOut >= s.prev.PgpgOut {
+			sample.DiskWritten = uint64(float64(1024*(counters.PgpgOut-s.prev.PgpgOut)) / secs)
+		}
+	}
+	s.prev = counters
+
+	// Neither of these is fatal; the sample just won't have them.
+	if loadavg, err := ioutil.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(loadavg)); len(fields) > 0 {
+			sample.LoadAvg, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	if meminfo, err := readProcTable("/proc/meminfo"); err == nil {
+		// these are in KiB
+		sample.MemTotal = 1024 * meminfo["MemTotal:"]
+		sample.MemAvailable = 1024 * meminfo["MemAvailable:"]
+		sample.SwapTotal = 1024 * meminfo["SwapTotal:"]
+		sample.SwapFree = 1024 * meminfo["SwapFree:"]
+	}
+
+	s.samples = append(s.samples, sample)
+}
+
+// Samples returns the samples that have been taken so far.
+func (s *sampler) Samples() []protocol.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]protocol.Sample(nil), s.samples...)
+}
+
+func readProcCounters(now time.Time) (procCounters, error) {
+	ret := procCounters{Time: now}
+
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return ret, err
+	}
+	// The first line is the total over all CPUs: "cpu user nice system idle iowait irq
+	// softirq steal guest guest_nice", in jiffies.  (guest and guest_nice are already counted
+	// in user and nice.)
+	line := strings.SplitN(string(stat), "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return ret, errors.Errorf("/proc/stat: unexpected first line: %q", line)
+	}
+	if len(fields) > 9 {
+		fields = fields[:9]
+	}
+	for i, field := range fields[1:] {
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return ret, errors.Wrapf(err, "/proc/stat: unexpected first line: %q", line)
+		}
+		ret.CPUTotal += n
+		if i == 3 || i == 4 { // idle, iowait
+			ret.CPUIdle += n
+		}
+	}
+
+	vmstat, err := readProcTable("/proc/vmstat")
+	if err != nil {
+		return ret, err
+	}
+	ret.PgpgIn = vmstat["pgpgin"]
+	ret.PgpgOut = vmstat["pgpgout"]
+
+	return ret, nil
+}
+
+// readProcTable reads a /proc file that has a name and a number on each line, like /proc/meminfo
+// or /proc/vmstat.
+func readProcTable(filename string) (map[string]uint64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ret := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			ret[fields[0]] = n
+		}
+	}
+	return ret, scanner.Err()
+}
@@ -0,0 +1,44 @@
+package runmake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alessio/shellescape"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+// shimSocketEnv is the environment variable that shims find the profiler's socket in.  Each
+// runshell rewrites the socket path in its child's environment, so a shim reports to the command
+// that it's running inside of.
+const shimSocketEnv = "PROFILE_MAKE_SOCKET"
+
+// writeShims writes a wrapper script for each of the named programs in to dir.  Putting dir at
+// the front of $PATH makes each run of those programs get reported as a sub-command of whatever
+// recipe command it's running inside of, even if it's run from deep inside a shell script.
+func writeShims(dir, exe string, programs []string) error {
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return err
+	}
+	for _, program := range programs {
+		if program == "" || strings.Contains(program, "/") {
+			return errors.Errorf("invalid --shim: %q: expected a program name, not a path", program)
+		}
+		script := fmt.Sprintf("#!/bin/sh\n"+
+			"exec %s shell --shim.dir=%s --profile.socket=\"$%s\" --make.level=\"${%s:-0}\" -- %s \"$@\"\n",
+			shellescape.Quote(exe),
+			shellescape.Quote(dir),
+			shimSocketEnv,
+			protocol.MakeLevelEnv,
+			shellescape.Quote(program))
+		if err := ioutil.WriteFile(filepath.Join(dir, program), []byte(script), 0777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
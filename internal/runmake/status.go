@@ -0,0 +1,245 @@
+package runmake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/profile-make/internal/protocol"
+	"github.com/datawire/profile-make/internal/shellparse"
+)
+
+// statusCheckInterval is how often the statusTracker checks for commands that have run for too
+// long.
+const statusCheckInterval = 250 * time.Millisecond
+
+// maxStatusLabel is how much of each command's text to show in warnings and dumps.
+const maxStatusLabel = 100
+
+type runningCommand struct {
+	protocol.RunningCommand
+	conn net.Conn
+
+	// lastBusy is the last time that any of the command's sub-commands were running; the
+	// timeout and warnings go by how long the command has been running by itself, so that a
+	// recipe that runs a long sub-make doesn't count as stuck.
+	lastBusy time.Time
+	warned   int
+	timedOut bool
+}
+
+// statusTracker keeps track of what's running right now, using the status socket.
+type statusTracker struct {
+	TopDir        string
+	RecipeTimeout time.Duration
+	WarnAfter     time.Duration
+
+	mu      sync.Mutex
+	running map[int]*runningCommand
+}
+
+func (t *statusTracker) Serve(listener net.Listener) {
+	t.mu.Lock()
+	t.running = make(map[int]*runningCommand)
+	t.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.handle(conn)
+	}
+}
+
+func (t *statusTracker) handle(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	cmd := &runningCommand{conn: conn}
+	if err := decoder.Decode(&cmd.RunningCommand); err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.running[cmd.ID] = cmd
+	t.mu.Unlock()
+
+	// the connection stays open until the command finishes
+	_, _ = io.Copy(ioutil.Discard, conn)
+
+	t.mu.Lock()
+	delete(t.running, cmd.ID)
+	if parent, ok := t.running[cmd.ParentID]; ok {
+		parent.lastBusy = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+// Watch enforces RecipeTimeout and WarnAfter until done is closed.
+func (t *statusTracker) Watch(done <-chan struct{}) {
+	if t.RecipeTimeout <= 0 && t.WarnAfter <= 0 {
+		return
+	}
+	ticker := time.NewTicker(statusCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			t.check(now)
+		}
+	}
+}
+
+func (t *statusTracker) check(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, cmd := range t.running {
+		if parent, ok := t.running[cmd.ParentID]; ok {
+			parent.lastBusy = now
+		}
+	}
+	for _, cmd := range t.running {
+		idleSince := cmd.StartTime
+		if cmd.lastBusy.After(idleSince) {
+			idleSince = cmd.lastBusy
+		}
+		idle := now.Sub(idleSince)
+		if t.RecipeTimeout > 0 && idle > t.RecipeTimeout && !cmd.timedOut {
+			cmd.timedOut = true
+			fmt.Fprintf(os.Stderr, "profile-make: error: %s timed out after %s; killing it: %s\n",
+				t.describe(cmd), t.RecipeTimeout, t.label(cmd))
+			_ = json.NewEncoder(cmd.conn).Encode(protocol.StatusReply{TimedOut: true})
+		}
+		// warn at each multiple of WarnAfter, so that it's clear that it's still going; unless
+		// it's been killed, which says so already
+		if t.WarnAfter > 0 && !cmd.timedOut && int(idle/t.WarnAfter) > cmd.warned {
+			cmd.warned = int(idle / t.WarnAfter)
+			fmt.Fprintf(os.Stderr, "profile-make: warning: %s has been running for %s: %s\n",
+				t.describe(cmd), roundDuration(now.Sub(cmd.StartTime)), t.label(cmd))
+		}
+	}
+}
+
+// describe names the recipe that the command is part of.
+func (t *statusTracker) describe(cmd *runningCommand) string {
+	switch {
+	case cmd.Shim:
+		return "a shimmed program"
+	case cmd.RecipeTarget == "":
+		return fmt.Sprintf("a parse-time command (make level %d)", cmd.MakeLevel)
+	default:
+		return fmt.Sprintf("the recipe for %q", t.rel(cmd.RecipeTarget))
+	}
+}
+
+func (t *statusTracker) label(cmd *runningCommand) string {
+	label := shellparse.ParseArgs(cmd.Args).Label()
+	if len(label) > maxStatusLabel {
+		label = label[:maxStatusLabel-3] + "..."
+	}
+	return label
+}
+
+func (t *statusTracker) rel(filename string) string {
+	if rel, err := filepath.Rel(t.TopDir, filename); err == nil {
+		return rel
+	}
+	return filename
+}
+
+// Dump writes the tree of currently running commands.
+func (t *statusTracker) Dump(w io.Writer, buildStart time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+
+	children := make(map[int][]*runningCommand)
+	for _, cmd := range t.running {
+		parent := cmd.ParentID
+		if _, ok := t.running[parent]; !ok {
+			parent = 0
+		}
+		children[parent] = append(children[parent], cmd)
+	}
+	for _, list := range children {
+		sort.Slice(list, func(i, j int) bool { return list[i].StartTime.Before(list[j].StartTime) })
+	}
+
+	var str strings.Builder
+	fmt.Fprintf(&str, "profile-make: %d commands running, %s into the build:\n",
+		len(t.running), roundDuration(now.Sub(buildStart)))
+	var walk func(parent int, depth int)
+	walk = func(parent int, depth int) {
+		for _, cmd := range children[parent] {
+			dir := t.rel(cmd.MakeDir)
+			fmt.Fprintf(&str, "%s- [%s] make[%d] in %s: %s (pid %d): %s\n",
+				strings.Repeat("  ", depth+1),
+				roundDuration(now.Sub(cmd.StartTime)),
+				cmd.MakeLevel, dir,
+				t.describe(cmd), cmd.ID,
+				t.label(cmd))
+			walk(cmd.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	_, _ = io.WriteString(w, str.String())
+}
+
+// Unfinished returns the commands that are still running, as of now, nested by what they're
+// running inside of.  This is only as good as the status socket: the commands that have already
+// finished inside of a command that's still running never got reported to us, so they're missing.
+func (t *statusTracker) Unfinished(now time.Time) []protocol.ProfiledCommand {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	children := make(map[int][]*runningCommand)
+	for _, cmd := range t.running {
+		parent := cmd.ParentID
+		if _, ok := t.running[parent]; !ok {
+			parent = 0
+		}
+		children[parent] = append(children[parent], cmd)
+	}
+	var build func(parent int) []protocol.ProfiledCommand
+	build = func(parent int) []protocol.ProfiledCommand {
+		list := children[parent]
+		sort.Slice(list, func(i, j int) bool { return list[i].StartTime.Before(list[j].StartTime) })
+		var ret []protocol.ProfiledCommand
+		for _, cmd := range list {
+			ret = append(ret, protocol.ProfiledCommand{
+				StartTime:  cmd.StartTime,
+				FinishTime: now,
+
+				MakeLevel:    cmd.MakeLevel,
+				MakeDir:      cmd.MakeDir,
+				RecipeTarget: cmd.RecipeTarget,
+				Shim:         cmd.Shim,
+
+				Args:       cmd.Args,
+				ExitCode:   -1,
+				TimedOut:   cmd.timedOut,
+				Unfinished: true,
+
+				SubCommands: build(cmd.ID),
+			})
+		}
+		return ret
+	}
+	return build(0)
+}
+
+// roundDuration rounds a duration to a precision that's useful for a human watching a build.
+func roundDuration(d time.Duration) time.Duration {
+	if d >= time.Minute {
+		return d.Round(time.Second)
+	}
+	return d.Round(10 * time.Millisecond)
+}
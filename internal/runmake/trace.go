@@ -0,0 +1,184 @@
+package runmake
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+// traceRE matches the lines that `make --trace` prints before running a recipe, such as
+//
+//	Makefile:7: update target 'out/a.o' due to: a.c
+//	Makefile:5: target 'out' does not exist
+//	<builtin>: update target 'foo.o' due to: foo.c
+//	Makefile:3: update target 'all' due to: target is .PHONY
+//
+// (Make 4.4 and later always say "update target ... due to:", giving the reason that older versions
+// put as "target ... does not exist" after "due to:" instead.)  The target is submatch 2 or 3,
+// depending on which form the line is.
+var traceRE = regexp.MustCompile(`^(<builtin>|.+?:[0-9]+): (?:update target '(.*)' due to: .*|target '(.*)' does not exist)$`)
+
+// traceSlack is how much later than the command's start we might see the trace line for it; make
+// prints the line before starting the recipe, but we read it from a pipe, and runshell reads the
+// clock in a different process.
+const traceSlack = time.Second
+
+type traceEvent struct {
+	Time   time.Time
+	Source string // "FILE:LINE", with FILE relative to the make's directory
+	Target string // as make spells it; relative to the make's directory
+}
+
+// traceFilter copies make's stdout through to w, keeping the --trace lines that say where each
+// recipe was defined, rather than passing them through.
+type traceFilter struct {
+	events []traceEvent
+
+	// byTarget indexes events by their target, cleaned, for Annotate; except for those whose
+	// target starts with "..", which are in upTargets instead.  Both hold indexes into events,
+	// in order.
+	byTarget  map[string][]int
+	upTargets []int
+}
+
+// Filter copies r to w, less the trace lines, which it keeps.  It reads r to the end even if
+// writing to w fails, so that make doesn't block writing to a full pipe; the first write error is
+// returned once it's done.
+func (f *traceFilter) Filter(w io.Writer, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	var writeErr error
+	for {
+		line, err := reader.ReadString('\n')
+		if match := traceRE.FindStringSubmatch(strings.TrimSuffix(line, "\n")); match != nil {
+			f.events = append(f.events, traceEvent{
+				Time:   time.Now(),
+				Source: match[1],
+				Target: match[2] + match[3],
+			})
+		} else if line != "" && writeErr == nil {
+			_, writeErr = io.WriteString(w, line)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return writeErr
+			}
+			return err
+		}
+	}
+}
+
+// Annotate sets RecipeSource on each of the commands (recursively) that it can match to a trace
+// line.  The trace doesn't say which make printed it, so a line is matched to a command if the
+// target that it names, taken relative to the command's make directory, is the command's target.
+// If there are several such lines, the last one before the command started wins.
+//
+// Under --output-sync, make holds on to the trace line along with the rest of the recipe's output
+// until the recipe finishes (or with --output-sync=recurse, until the recipe that ran the sub-make
+// finishes), so the line may come well after the command started.
+func (f *traceFilter) Annotate(cmds []protocol.ProfiledCommand) {
+	f.annotate(cmds, time.Time{})
+}
+
+type recipeKey struct {
+	Dir      string
+	Restarts uint
+	Target   string
+}
+
+func outputSynced(mode string) bool {
+	return mode != "" && mode != "none"
+}
+
+// annotate is Annotate for the commands run by one make; heldUntil is when the output of an outer
+// make that's syncing with --output-sync=recurse was released.
+func (f *traceFilter) annotate(cmds []protocol.ProfiledCommand, heldUntil time.Time) {
+	recipeFinish := make(map[recipeKey]time.Time)
+	for _, cmd := range cmds {
+		key := recipeKey{cmd.MakeDir, cmd.MakeRestarts, cmd.RecipeTarget}
+		if cmd.FinishTime.After(recipeFinish[key]) {
+			recipeFinish[key] = cmd.FinishTime
+		}
+	}
+	for i := range cmds {
+		cmd := &cmds[i]
+		key := recipeKey{cmd.MakeDir, cmd.MakeRestarts, cmd.RecipeTarget}
+		until := cmd.StartTime
+		if outputSynced(cmd.MakeOutputSync) {
+			until = recipeFinish[key]
+		}
+		if heldUntil.After(until) {
+			until = heldUntil
+		}
+		if cmd.RecipeTarget != "" {
+			if match := f.lastEvent(cmd.MakeDir, cmd.RecipeTarget, until.Add(traceSlack)); match != nil {
+				cmd.RecipeSource = match.Source
+				if !strings.HasPrefix(match.Source, "<") {
+					cmd.RecipeSource = absPath(cmd.MakeDir, match.Source)
+				}
+			}
+		}
+		subHeldUntil := heldUntil
+		if cmd.MakeOutputSync == "recurse" && recipeFinish[key].After(subHeldUntil) {
+			subHeldUntil = recipeFinish[key]
+		}
+		f.annotate(cmd.SubCommands, subHeldUntil)
+	}
+}
+
+// lastEvent returns the last trace event, no later than deadline, whose target is target when
+// taken relative to dir; or nil if there isn't one.
+func (f *traceFilter) lastEvent(dir, target string, deadline time.Time) *traceEvent {
+	if f.byTarget == nil {
+		f.byTarget = make(map[string][]int)
+		for i, event := range f.events {
+			spelling := filepath.Clean(event.Target)
+			if spelling == ".." || strings.HasPrefix(spelling, "../") {
+				f.upTargets = append(f.upTargets, i)
+			} else {
+				f.byTarget[spelling] = append(f.byTarget[spelling], i)
+			}
+		}
+	}
+	// The events are in the order that they happened, so the ones that are early enough are a
+	// prefix of each list.
+	last := -1
+	lastBefore := func(indexes []int) {
+		n := sort.Search(len(indexes), func(j int) bool {
+			return f.events[indexes[j]].Time.After(deadline)
+		})
+		if n > 0 && indexes[n-1] > last {
+			last = indexes[n-1]
+		}
+	}
+	// A target that doesn't start with ".." names target only if it's target itself, or the
+	// path to it from dir.
+	lastBefore(f.byTarget[target])
+	if rel, err := filepath.Rel(dir, target); err == nil && !filepath.IsAbs(rel) {
+		lastBefore(f.byTarget[rel])
+	}
+	for _, i := range f.upTargets {
+		if f.events[i].Time.After(deadline) {
+			break
+		}
+		if i > last && absPath(dir, f.events[i].Target) == target {
+			last = i
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	return &f.events[last]
+}
+
+func absPath(dir, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filepath.Clean(filename)
+	}
+	return filepath.Join(dir, filename)
+}
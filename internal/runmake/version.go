@@ -0,0 +1,271 @@
+package runmake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type makeVersion struct {
+	Major, Minor int
+	// String is the first line of `make --version`, such as "GNU Make 4.3".
+	String string
+}
+
+func (v makeVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// minMakeVersion is the oldest GNU Make that has everything that the profiling shell relies on:
+// $(abspath), $(or), and MAKE_RESTARTS.
+var minMakeVersion = makeVersion{Major: 3, Minor: 81, String: "GNU Make 3.81"}
+
+var makeVersionRE = regexp.MustCompile(`^GNU Make ([0-9]+)\.([0-9]+)`)
+
+// detectMakeVersion runs `make --version` to find out what version of GNU Make the make program
+// is.  Other makes (BSD make, for instance) don't understand --version, or don't say "GNU Make".
+func detectMakeVersion(program string) (makeVersion, error) {
+	out, err := exec.Command(program, "--version").CombinedOutput()
+	if _, isExecErr := err.(*exec.Error); isExecErr {
+		return makeVersion{}, err
+	}
+	firstLine := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	match := makeVersionRE.FindStringSubmatch(firstLine)
+	if match == nil {
+		return makeVersion{}, errors.Errorf("profile-make requires GNU Make, but %q doesn't appear to be GNU Make; `%s --version` said: %q\n"+
+			"  (If %q runs make, run make directly instead.)",
+			program, program, firstLine, program)
+	}
+	ret := makeVersion{String: firstLine}
+	ret.Major, _ = strconv.Atoi(match[1])
+	ret.Minor, _ = strconv.Atoi(match[2])
+	if !ret.AtLeast(minMakeVersion.Major, minMakeVersion.Minor) {
+		return makeVersion{}, errors.Errorf("profile-make requires %s or newer, but %q is %s",
+			minMakeVersion.String, program, firstLine)
+	}
+	return ret, nil
+}
+
+func inArray(needle string, haystack []string) bool {
+	for _, straw := range haystack {
+		if straw == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// makeWrappers are programs that make is often run through, to run it in a different environment,
+// and that run the rest of their arguments as a command.  For each, the options that take the next
+// argument as their value, and how many other arguments come before the command.
+var makeWrappers = map[string]struct {
+	optionArgs  []string
+	positionals int
+}{
+	"env":     {optionArgs: []string{"-u", "--unset", "-C", "--chdir"}},
+	"nice":    {optionArgs: []string{"-n", "--adjustment"}},
+	"ionice":  {optionArgs: []string{"-c", "--class", "-n", "--classdata"}},
+	"nohup":   {},
+	"time":    {optionArgs: []string{"-f", "--format", "-o", "--output"}},
+	"timeout": {optionArgs: []string{"-k", "--kill-after", "-s", "--signal"}, positionals: 1},
+	"stdbuf":  {optionArgs: []string{"-i", "--input", "-o", "--output", "-e", "--error"}},
+	"taskset": {positionals: 1},
+	"chrt":    {positionals: 1},
+}
+
+// makeCommand returns the part of the command line that runs make itself, skipping over any
+// makeWrappers (such as `env FOO=1` or `nice -n 10`) that make is run through.
+func makeCommand(cmdline []string) []string {
+	for len(cmdline) > 0 {
+		name := filepath.Base(cmdline[0])
+		wrapper, ok := makeWrappers[name]
+		if !ok {
+			return cmdline
+		}
+		args := cmdline[1:]
+		positionals := wrapper.positionals
+		options := true
+	wrapperArgs:
+		for len(args) > 0 {
+			arg := args[0]
+			switch {
+			case options && arg == "--":
+				options = false
+			case options && strings.HasPrefix(arg, "-"):
+				if inArray(arg, wrapper.optionArgs) && len(args) > 1 {
+					args = args[1:]
+				}
+			case name == "env" && strings.Contains(arg, "="):
+				// a variable assignment
+			case positionals > 0:
+				positionals--
+			default:
+				break wrapperArgs
+			}
+			args = args[1:]
+		}
+		cmdline = args
+	}
+	return cmdline
+}
+
+// groupedTargetRE matches a rule with grouped targets ("TARGETS &: PREREQUISITES"); makes older
+// than 4.3 take the "&" for a target of its own.
+var groupedTargetRE = regexp.MustCompile(`^[^\t#=:][^#=:]*&::?([^=]|$)`)
+
+// makeLongOptionMinLen is how short each of make's long options that checkMakeFeatures cares about
+// can be abbreviated to; make accepts any prefix of one that isn't also a prefix of another.
+var makeLongOptionMinLen = map[string]int{
+	"output-sync": len("ou"),
+	"shuffle":     len("sh"),
+	"file":        len("f"),
+	"makefile":    len("mak"),
+	"directory":   len("di"),
+	"include-dir": len("in"),
+	"old-file":    len("ol"),
+	"assume-old":  len("assume-o"),
+	"new-file":    len("ne"),
+	"assume-new":  len("assume-n"),
+	"what-if":     len("wh"),
+	"eval":        len("ev"),
+}
+
+// makeLongValueOptions are the rest of make's long options that take a value, which can be the
+// next argument.
+var makeLongValueOptions = []string{"include-dir", "old-file", "assume-old", "new-file", "assume-new", "what-if", "eval"}
+
+// isMakeLongOption returns whether name (a long option, without the "--") is option, or an
+// abbreviation of it.
+func isMakeLongOption(name, option string) bool {
+	return len(name) >= makeLongOptionMinLen[option] && strings.HasPrefix(option, name)
+}
+
+// checkMakeFeatures checks that the make is new enough for the features that its command line
+// uses, and for grouped targets in the makefile that it reads first; older makes either reject
+// them with a cryptic error, or quietly do something else.  (The makefiles that that one includes
+// aren't checked.)
+func checkMakeFeatures(version makeVersion, makeCmd []string) error {
+	requires := func(feature string, major, minor int) error {
+		if version.AtLeast(major, minor) {
+			return nil
+		}
+		return errors.Errorf("%s requires GNU Make %d.%d or newer, but %q is %s",
+			feature, major, minor, makeCmd[0], version.String)
+	}
+
+	dir := "."
+	var makefiles []string
+	args := makeCmd[1:]
+	// value returns the value of the option that args[i] ends with: attached, if it is, or else
+	// the next argument.
+	value := func(i *int, attached string) (string, bool) {
+		if attached != "" {
+			return attached, true
+		}
+		if *i+1 < len(args) {
+			*i++
+			return args[*i], true
+		}
+		return "", false
+	}
+args:
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var err error
+		switch {
+		case arg == "--":
+			break args
+		case strings.HasPrefix(arg, "--"):
+			name, attached := arg[2:], ""
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, attached = name[:eq], name[eq+1:]
+			}
+			switch {
+			case isMakeLongOption(name, "output-sync"):
+				err = requires("--output-sync", 4, 0)
+			case isMakeLongOption(name, "shuffle"):
+				err = requires("--shuffle", 4, 4)
+			case isMakeLongOption(name, "file"), isMakeLongOption(name, "makefile"):
+				if makefile, ok := value(&i, attached); ok {
+					makefiles = append(makefiles, makefile)
+				}
+			case isMakeLongOption(name, "directory"):
+				if chdir, ok := value(&i, attached); ok {
+					dir = absPath(dir, chdir)
+				}
+			default:
+				for _, option := range makeLongValueOptions {
+					if isMakeLongOption(name, option) {
+						value(&i, attached)
+						break
+					}
+				}
+			}
+		case strings.HasPrefix(arg, "-"):
+			// A bundle of short options, such as "-kO" or "-sC dir"; an option that takes a
+			// value takes the rest of the bundle, if there is any.
+		bundle:
+			for j := 1; j < len(arg); j++ {
+				switch arg[j] {
+				case 'O':
+					err = requires("--output-sync", 4, 0)
+					break bundle
+				case 'j', 'l':
+					// an optional value, which can only be attached
+					break bundle
+				case 'f':
+					if makefile, ok := value(&i, arg[j+1:]); ok {
+						makefiles = append(makefiles, makefile)
+					}
+					break bundle
+				case 'C':
+					if chdir, ok := value(&i, arg[j+1:]); ok {
+						dir = absPath(dir, chdir)
+					}
+					break bundle
+				case 'I', 'o', 'W':
+					value(&i, arg[j+1:])
+					break bundle
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(makefiles) == 0 {
+		for _, name := range []string{"GNUmakefile", "makefile", "Makefile"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				makefiles = append(makefiles, name)
+				break
+			}
+		}
+	}
+	for _, makefile := range makefiles {
+		if !filepath.IsAbs(makefile) {
+			makefile = filepath.Join(dir, makefile)
+		}
+		content, err := ioutil.ReadFile(makefile)
+		if err != nil {
+			// let make complain about it
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if groupedTargetRE.MatchString(line) {
+				if err := requires(fmt.Sprintf("%s uses grouped targets (&:), which", makefile), 4, 3); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
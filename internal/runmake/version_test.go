@@ -0,0 +1,147 @@
+package runmake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMakeCommand(t *testing.T) {
+	testcases := map[string]string{
+		"make -j4":                              "make -j4",
+		"/usr/bin/make":                         "/usr/bin/make",
+		"env FOO=1 make":                        "make",
+		"env -u HOME FOO=1 BAR=2 make -k":       "make -k",
+		"env -- make":                           "make",
+		"/usr/bin/env FOO=1 gmake":              "gmake",
+		"nice make":                             "make",
+		"nice -n 5 make":                        "make",
+		"nice -n5 make":                         "make",
+		"nice --adjustment=5 make":              "make",
+		"timeout 10 make":                       "make",
+		"timeout -s INT -k 5 10m make all":      "make all",
+		"time -f %e make":                       "make",
+		"taskset 0x3 make -j2":                  "make -j2",
+		"env FOO=1 nice -n 5 timeout 1h make":   "make",
+		"nohup stdbuf -o L make FOO=1":          "make FOO=1",
+		"env":                                   "",
+		"nice -n 5":                             "",
+		"env FOO=1 ./build.sh make":             "./build.sh make",
+		"ionice -c 3 -- env -i PATH=/bin make":  "make",
+		"chrt 10 env -u FOO -- nice -n 1 make":  "make",
+		"timeout --signal=TERM 5 make -C dir x": "make -C dir x",
+	}
+	for input, want := range testcases {
+		got := strings.Join(makeCommand(strings.Fields(input)), " ")
+		if got != want {
+			t.Errorf("makeCommand(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestCheckMakeFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile-make-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"Makefile":     "all: a b\n",
+		"grouped.mk":   "a b &: c\n\ttouch a b\n",
+		"sub/Makefile": "x y &:: z\n\ttouch x y\n",
+		"sub/plain.mk": "all: x\n",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// For each command line, the oldest make that can run it (0.0 if any can).
+	testcases := []struct {
+		Args         string
+		Major, Minor int
+	}{
+		{"", 0, 0},
+		{"-j4 -k all", 0, 0},
+
+		{"-f grouped.mk", 4, 3},
+		{"-fgrouped.mk", 4, 3},
+		{"-kf grouped.mk", 4, 3},
+		{"-kfgrouped.mk", 4, 3},
+		{"--file grouped.mk", 4, 3},
+		{"--file=grouped.mk", 4, 3},
+		{"--makefile=grouped.mk", 4, 3},
+		{"--mak=grouped.mk", 4, 3},
+		{"-f " + dir + "/grouped.mk", 4, 3},
+		{"-f Makefile -f grouped.mk", 4, 3},
+		{"-f Makefile", 0, 0},
+		{"-f missing.mk", 0, 0},
+
+		{"-C sub", 4, 3},
+		{"-Csub", 4, 3},
+		{"-sC sub", 4, 3},
+		{"-sCsub", 4, 3},
+		{"--directory sub", 4, 3},
+		{"--directory=sub", 4, 3},
+		{"--di=sub", 4, 3},
+		{"-C " + dir + "/sub", 4, 3},
+		{"-C /nonexistent -C " + dir + "/sub", 4, 3},
+		{"-C " + dir + " -C sub", 4, 3},
+		{"-C sub -f plain.mk", 0, 0},
+		{"-C sub -f ../grouped.mk", 4, 3},
+		{"-C sub -f " + dir + "/Makefile", 0, 0},
+		{"-C " + dir + "/sub -f plain.mk", 0, 0},
+
+		{"-O", 4, 0},
+		{"-Otarget", 4, 0},
+		{"-kO", 4, 0},
+		{"-sOline", 4, 0},
+		{"-k -O", 4, 0},
+		{"--output-sync", 4, 0},
+		{"--output-sync=line", 4, 0},
+		{"--ou=recurse", 4, 0},
+		{"-jO", 0, 0},   // that's -j with a value of "O", which make rejects
+		{"-o -O", 0, 0}, // that's -o with a value of "-O"
+		{"--eval -O", 0, 0},
+		{"--old-file=x -f -O", 0, 0},
+		{"-- -O", 0, 0},
+
+		{"--shuffle", 4, 4},
+		{"--shuffle=reverse", 4, 4},
+		{"--sh=random", 4, 4},
+		{"-O --shuffle", 4, 4},
+	}
+	versions := []makeVersion{
+		{Major: 3, Minor: 81},
+		{Major: 4, Minor: 0},
+		{Major: 4, Minor: 2},
+		{Major: 4, Minor: 3},
+		{Major: 4, Minor: 4},
+	}
+	for _, tc := range testcases {
+		for _, version := range versions {
+			version.String = fmt.Sprintf("GNU Make %d.%d", version.Major, version.Minor)
+			wantErr := !version.AtLeast(tc.Major, tc.Minor)
+			err := checkMakeFeatures(version, append([]string{"make"}, strings.Fields(tc.Args)...))
+			if (err != nil) != wantErr {
+				t.Errorf("%s: make %s: got err=%v, want error: %v", version.String, tc.Args, err, wantErr)
+			}
+		}
+	}
+}
@@ -7,23 +7,46 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 
 	"github.com/datawire/profile-make/internal/protocol"
 )
 
-func GetProfilingShell(exe, socketName string) string {
+// MakeFeatures describes the version of GNU Make that will be running the profiling shell, for
+// the things that differ between versions.
+type MakeFeatures struct {
+	// Wait is whether make has the .WAIT pseudo-prerequisite (4.4 and newer); it is filtered
+	// out of the prerequisite lists so that it never shows up as a dependency.
+	Wait bool
+}
+
+func GetProfilingShell(exe, socketName string, features MakeFeatures) string {
+	deps := func(automaticVar string) string {
+		if features.Wait {
+			return `$(abspath $(filter-out .WAIT,` + automaticVar + `))`
+		}
+		return `$(abspath ` + automaticVar + `)`
+	}
 	args := []string{
 		fmt.Sprintf(`%s %s --profile.socket=%s`, exe, "shell", socketName),
 		`--make.level=$(MAKELEVEL)`,
 		`--make.restarts=$(or $(MAKE_RESTARTS),0)`,
 		`--make.dir=$(CURDIR)`,
+		// make normalizes -O and --output-sync to "-OMODE"; use MFLAGS rather than MAKEFLAGS,
+		// since MAKEFLAGS also has the command-line variables, including this SHELL.
+		`--make.output-sync=$(patsubst -O%,%,$(filter -O%,$(MFLAGS)))`,
 		`--recipe.target=$(abspath $@)`,
-		`$(addprefix --recipe.dependency=,$(abspath $^))`,
+		`$(addprefix --recipe.dependency=,` + deps(`$^`) + `)`,
+		`$(addprefix --recipe.order-only=,` + deps(`$|`) + `)`,
+		`$(addprefix --recipe.newer=,` + deps(`$?`) + `)`,
 		`--`,
 		`$(or $(profile-make.SHELL),/bin/sh)`,
 	}
@@ -39,6 +62,11 @@ func (stderrLogger) Printf(format string, a ...interface{}) (n int, err error) {
 func Main(args ...string) error {
 	startTime := time.Now() // do this as early as possible
 
+	// Don't die on a signal before the command has a chance to; see supervise().
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
 	// 0: parse arguments //////////////////////////////////////////////////
 	argparser := pflag.NewFlagSet("shell", pflag.ContinueOnError)
 	var (
@@ -46,25 +74,59 @@ func Main(args ...string) error {
 		argMakeLevel          = argparser.Uint("make.level", 0, "$(MAKELEVEL)")
 		argMakeRestarts       = argparser.Uint("make.restarts", 0, "$(MAKE_RESTARTS)")
 		argMakeDir            = argparser.String("make.dir", "", "$(CURDIR)")
+		argMakeOutputSync     = argparser.String("make.output-sync", "", "--output-sync mode, from $(MFLAGS)")
 		argRecipeTarget       = argparser.String("recipe.target", "", "$@")
 		argRecipeDependencies = argparser.StringArray("recipe.dependency", nil, "$^")
+		argRecipeOrderOnly    = argparser.StringArray("recipe.order-only", nil, "$|")
+		argRecipeNewer        = argparser.StringArray("recipe.newer", nil, "$?")
+		argShimDir            = argparser.String("shim.dir", "", "Run as a `run --shim` wrapper; the directory of wrappers to skip when looking up the program")
 	)
 	err := argparser.Parse(args)
 	if err != nil {
 		return err
 	}
 	cmdline := argparser.Args()
+	if len(cmdline) == 0 {
+		return errors.New("expected a command to run")
+	}
+
+	// For a shim, make didn't tell us anything; look up the real program, and go by the working
+	// directory.
+	cmdPath := cmdline[0]
+	if *argShimDir != "" {
+		cmdPath, err = lookPathExcept(cmdline[0], *argShimDir)
+		if err != nil {
+			return err
+		}
+		if *argMakeDir == "" {
+			*argMakeDir, _ = os.Getwd()
+		}
+	}
 
 	// 1: connect to parent ////////////////////////////////////////////////
 	// do this as early as possible
 	conn, connErr := net.Dial("unix", *argProfileSocket)
 	if connErr != nil {
+		if *argShimDir != "" {
+			// The shim got run by something that isn't being profiled (perhaps
+			// something that outlived the build, or that scrubbed its environment);
+			// get out of the way.
+			return runUnprofiled(cmdPath, cmdline)
+		}
 		return connErr
 	}
 	defer conn.Close()
 
 	// 2: run the command //////////////////////////////////////////////////
 
+	// do this before the command has a chance to create the target
+	var targetExisted *bool
+	if *argRecipeTarget != "" {
+		_, statErr := os.Stat(*argRecipeTarget)
+		existed := statErr == nil
+		targetExisted = &existed
+	}
+
 	socketDir, socketNotdir := filepath.Split(*argProfileSocket)
 	tmpdir, err := ioutil.TempDir(socketDir, socketNotdir+".")
 	if err != nil {
@@ -73,10 +135,24 @@ func Main(args ...string) error {
 	defer os.RemoveAll(tmpdir)
 	listenerName := filepath.Join(tmpdir, "socket")
 
+	status := dialStatus(protocol.RunningCommand{
+		ID:           os.Getpid(),
+		ParentID:     parentID(),
+		StartTime:    startTime,
+		MakeLevel:    *argMakeLevel,
+		MakeDir:      *argMakeDir,
+		RecipeTarget: *argRecipeTarget,
+		Shim:         *argShimDir != "",
+		Args:         cmdline,
+	})
+	defer status.Close()
+
 	var cmdErr error
 	var cmdState *os.ProcessState
+	var timedOut bool
 	subCmds, err := protocol.WithServer(listenerName, stderrLogger{}, func() {
-		cmd := exec.Command(cmdline[0], cmdline[1:]...)
+		cmd := exec.Command(cmdPath, cmdline[1:]...)
+		cmd.Args[0] = cmdline[0]
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
@@ -87,8 +163,23 @@ func Main(args ...string) error {
 		for i := range cmd.Env {
 			cmd.Env[i] = strings.ReplaceAll(cmd.Env[i], *argProfileSocket, listenerName)
 		}
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("%s=%d", protocol.StatusParentEnv, os.Getpid()),
+			fmt.Sprintf("%s=%d", protocol.MakeLevelEnv, *argMakeLevel))
 
-		cmdErr = cmd.Run()
+		ownGroup := os.Getenv(protocol.OwnProcessGroupEnv) != ""
+		if ownGroup {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		}
+		if cmdErr = cmd.Start(); cmdErr != nil {
+			return
+		}
+		exited := make(chan struct{})
+		go func() {
+			cmdErr = cmd.Wait()
+			close(exited)
+		}()
+		timedOut = supervise(cmd.Process, ownGroup, sigs, status.TimedOut(), exited)
 		cmdState = cmd.ProcessState
 	})
 	if err != nil {
@@ -99,19 +190,37 @@ func Main(args ...string) error {
 
 	finishTime := time.Now() // do this as late as possible
 
+	exitCode := -1
+	var userTime, systemTime time.Duration
+	if cmdState != nil {
+		exitCode = cmdState.ExitCode()
+		userTime = cmdState.UserTime()
+		systemTime = cmdState.SystemTime()
+	}
+
 	err = json.NewEncoder(conn).Encode(protocol.ProfiledCommand{
 		StartTime:  startTime,
 		FinishTime: finishTime,
 
-		MakeLevel:    *argMakeLevel,
-		MakeRestarts: *argMakeRestarts,
-		MakeDir:      *argMakeDir,
+		MakeLevel:      *argMakeLevel,
+		MakeRestarts:   *argMakeRestarts,
+		MakeDir:        *argMakeDir,
+		MakeOutputSync: *argMakeOutputSync,
+
+		RecipeTarget:                *argRecipeTarget,
+		RecipeDependencies:          *argRecipeDependencies,
+		RecipeOrderOnlyDependencies: *argRecipeOrderOnly,
+		RecipeNewerDependencies:     *argRecipeNewer,
+		RecipeTargetExisted:         targetExisted,
 
-		RecipeTarget:       *argRecipeTarget,
-		RecipeDependencies: *argRecipeDependencies,
+		Shim: *argShimDir != "",
 
 		Args:         cmdline,
 		ProcessState: cmdState,
+		ExitCode:     exitCode,
+		UserTime:     userTime,
+		SystemTime:   systemTime,
+		TimedOut:     timedOut,
 
 		SubCommands: subCmds,
 	})
@@ -122,3 +231,39 @@ func Main(args ...string) error {
 	// 4: exit /////////////////////////////////////////////////////////////
 	return cmdErr
 }
+
+// lookPathExcept is like exec.LookPath, but skips the given directory in $PATH, so that a shim
+// doesn't find itself.
+func lookPathExcept(file, skipDir string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		if filepath.Clean(dir) == filepath.Clean(skipDir) {
+			continue
+		}
+		path := filepath.Join(dir, file)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func runUnprofiled(cmdPath string, cmdline []string) error {
+	cmd := exec.Command(cmdPath, cmdline[1:]...)
+	cmd.Args[0] = cmdline[0]
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// parentID returns the status ID of the command that this one is running inside of, or 0.
+func parentID() int {
+	id, _ := strconv.Atoi(os.Getenv(protocol.StatusParentEnv))
+	return id
+}
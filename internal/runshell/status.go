@@ -0,0 +1,166 @@
+package runshell
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+// killGrace is how long a timed-out command gets to exit after SIGTERM before it gets SIGKILL.
+const killGrace = 5 * time.Second
+
+// statusConn is runshell's connection to the status socket, if there is one.
+type statusConn struct {
+	conn     net.Conn
+	timedOut chan struct{}
+}
+
+// dialStatus tells the status socket (if profile-make run gave us one) that the command has
+// started.  It never fails; the status socket is only nice-to-have.
+func dialStatus(info protocol.RunningCommand) *statusConn {
+	ret := &statusConn{
+		timedOut: make(chan struct{}),
+	}
+	socketName := os.Getenv(protocol.StatusSocketEnv)
+	if socketName == "" {
+		return ret
+	}
+	conn, err := net.Dial("unix", socketName)
+	if err != nil {
+		return ret
+	}
+	if err := json.NewEncoder(conn).Encode(info); err != nil {
+		conn.Close()
+		return ret
+	}
+	ret.conn = conn
+	go func() {
+		decoder := json.NewDecoder(conn)
+		for {
+			var reply protocol.StatusReply
+			if err := decoder.Decode(&reply); err != nil {
+				return
+			}
+			if reply.TimedOut {
+				close(ret.timedOut)
+				return
+			}
+		}
+	}()
+	return ret
+}
+
+// Close tells the status socket that the command has finished.
+func (s *statusConn) Close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// TimedOut is closed if profile-make run decides that the command has run for too long.
+func (s *statusConn) TimedOut() <-chan struct{} {
+	return s.timedOut
+}
+
+// supervise waits for the command to exit, passing signals along to it, and killing it if it
+// times out; it returns whether it timed out.
+//
+// If the command is in its own process group, signals from the terminal only reach runshell, so
+// they all get passed along to the whole group.  Otherwise, SIGINT already reached the command
+// along with the rest of the process group (from the terminal, or from `profile-make run`), but
+// make sends SIGTERM to just its own children.
+func supervise(proc *os.Process, ownGroup bool, sigs <-chan os.Signal, timedOut <-chan struct{}, exited <-chan struct{}) bool {
+	var killTimer <-chan time.Time
+	ret := false
+	for {
+		select {
+		case <-exited:
+			return ret
+		case sig := <-sigs:
+			switch {
+			case ownGroup:
+				_ = syscall.Kill(-proc.Pid, sig.(syscall.Signal))
+			case sig != syscall.SIGINT:
+				_ = proc.Signal(sig)
+			}
+		case <-timedOut:
+			// Timeouts only get enabled along with OwnProcessGroupEnv.
+			timedOut = nil
+			ret = true
+			_ = syscall.Kill(-proc.Pid, syscall.SIGTERM)
+			killTimer = time.After(killGrace)
+		case <-killTimer:
+			killTree(proc.Pid)
+		}
+	}
+}
+
+// killTree SIGKILLs the process group that pid leads, along with the groups of all of its
+// descendants.  Nested runshells (for shims, or for a sub-make's recipes) put their commands in
+// groups of their own; a command in one that ignored the SIGTERM would outlive its runshell
+// otherwise.
+func killTree(pid int) {
+	pgids := map[int]struct{}{pid: {}}
+	for _, proc := range descendants(pid) {
+		pgids[proc.Pgid] = struct{}{}
+	}
+	for pgid := range pgids {
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+type procInfo struct {
+	Pid, Ppid, Pgid int
+}
+
+// descendants returns the processes that descend from pid, according to /proc; none if it can't
+// be read.
+func descendants(pid int) []procInfo {
+	dir, err := os.Open("/proc")
+	if err != nil {
+		return nil
+	}
+	names, _ := dir.Readdirnames(-1)
+	dir.Close()
+	children := make(map[int][]procInfo)
+	for _, name := range names {
+		if _, err := strconv.Atoi(name); err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", name, "stat"))
+		if err != nil {
+			continue // it exited
+		}
+		// "PID (COMM) STATE PPID PGRP ..."; COMM may have spaces or parens in it.
+		var proc procInfo
+		var state string
+		fields := string(stat)
+		if i := strings.LastIndexByte(fields, ')'); i >= 0 {
+			fields = fields[i+1:]
+		}
+		if _, err := fmt.Sscan(fields, &state, &proc.Ppid, &proc.Pgid); err != nil {
+			continue
+		}
+		proc.Pid, _ = strconv.Atoi(name)
+		children[proc.Ppid] = append(children[proc.Ppid], proc)
+	}
+	var ret []procInfo
+	queue := []int{pid}
+	for len(queue) > 0 {
+		for _, child := range children[queue[0]] {
+			ret = append(ret, child)
+			queue = append(queue, child.Pid)
+		}
+		queue = queue[1:]
+	}
+	return ret
+}
@@ -0,0 +1,322 @@
+// Package shellparse picks apart the command lines that make runs, so that they can be labeled and
+// classified by the programs that they actually run, rather than all reading "/bin/sh -c '...'".
+package shellparse
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/alessio/shellescape"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+var shells = map[string]struct{}{
+	"sh":   {},
+	"ash":  {},
+	"dash": {},
+	"bash": {},
+	"ksh":  {},
+	"zsh":  {},
+}
+
+// wrappers are programs that run another program that's named in their arguments.  The value is
+// the set of flags that take a separate argument.
+var wrappers = map[string][]string{
+	"env":     {"-u", "-C", "-S"},
+	"exec":    {"-a"},
+	"command": nil,
+	"builtin": nil,
+	"time":    {"-f", "-o"},
+	"nice":    {"-n"},
+	"nohup":   nil,
+	"sudo":    {"-u", "-g", "-C", "-D", "-h", "-p"},
+	"timeout": {"-k", "-s"},
+	"xargs":   {"-a", "-d", "-E", "-I", "-L", "-n", "-P", "-s"},
+}
+
+// trivial are programs that commonly show up alongside the "real" command of a recipe line, and
+// that shouldn't be the thing that a command is classified by if there's anything else.
+var trivial = map[string]struct{}{
+	":":      {},
+	"[":      {},
+	"cd":     {},
+	"echo":   {},
+	"export": {},
+	"false":  {},
+	"mkdir":  {},
+	"printf": {},
+	"rm":     {},
+	"set":    {},
+	"test":   {},
+	"touch":  {},
+	"trap":   {},
+	"true":   {},
+	"umask":  {},
+	"unset":  {},
+}
+
+// Span is a run of script text that is highlighted the same way.  Class is one of "program",
+// "assignment", "redirect", "operator", "keyword", "string", "expansion", "comment", or "" for
+// plain text.
+type Span struct {
+	Class string
+	Text  string
+}
+
+// Script is a parsed command line.
+type Script struct {
+	// Shell is the shell that ran the script, or "" if the command line wasn't a shell
+	// script.
+	Shell string
+	// Source is the text of the script; if the command line wasn't a shell script, it's the
+	// shell-quoted command line.
+	Source string
+	// File is the parsed Source, without its comments, or nil if it couldn't be parsed.
+	File *syntax.File
+	// Programs are the names of the programs that the script runs, in the order that they
+	// appear.
+	Programs []string
+
+	programWords map[*syntax.Word]struct{}
+}
+
+// splitShell returns the shell and script from a "SHELL [FLAGS] -c SCRIPT" command line, or ""
+// for both if that's not what the command line is.
+func splitShell(args []string) (shell, script string) {
+	if len(args) < 3 {
+		return "", ""
+	}
+	if _, ok := shells[filepath.Base(args[0])]; !ok {
+		return "", ""
+	}
+	for i := 1; i < len(args)-1; i++ {
+		switch {
+		case args[i] == "-o" || args[i] == "+o":
+			i++
+		case args[i] == "--" || strings.HasPrefix(args[i], "--"):
+			return "", ""
+		case !strings.HasPrefix(args[i], "-") && !strings.HasPrefix(args[i], "+"):
+			return "", ""
+		case strings.ContainsRune(args[i], 'c'):
+			return args[0], args[i+1]
+		case strings.ContainsRune(args[i], 'o'):
+			// "-eo pipefail"
+			i++
+		}
+	}
+	return "", ""
+}
+
+// ParseArgs parses a command line, as would be passed to execve().
+func ParseArgs(args []string) *Script {
+	s := &Script{
+		programWords: make(map[*syntax.Word]struct{}),
+	}
+	s.Shell, s.Source = splitShell(args)
+	if s.Shell == "" {
+		quoted := make([]string, len(args))
+		for i := range args {
+			quoted[i] = shellescape.Quote(args[i])
+		}
+		s.Source = strings.Join(quoted, " ")
+	}
+
+	// Leave the comments out, for Label; SingleLine can't put a comment in the middle of a
+	// line.  Highlight finds them for itself.
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(s.Source), "")
+	if err != nil {
+		if fields := strings.Fields(s.Source); len(fields) > 0 {
+			s.Programs = []string{filepath.Base(fields[0])}
+		}
+		return s
+	}
+	s.File = file
+	syntax.Walk(file, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok {
+			if word := programWord(call.Args); word != nil {
+				s.programWords[word] = struct{}{}
+				s.Programs = append(s.Programs, filepath.Base(wordText(word)))
+			}
+		}
+		return true
+	})
+	return s
+}
+
+// programWord returns the word that names the program that a simple command runs, looking
+// through wrappers like "env" and "nice".
+func programWord(args []*syntax.Word) *syntax.Word {
+	for len(args) > 0 {
+		name := filepath.Base(wordText(args[0]))
+		argFlags, isWrapper := wrappers[name]
+		if !isWrapper {
+			return args[0]
+		}
+		rest := args[1:]
+		// skip the wrapper's own arguments
+		for len(rest) > 0 {
+			arg := wordText(rest[0])
+			if arg == "--" {
+				rest = rest[1:]
+				break
+			}
+			if !strings.HasPrefix(arg, "-") && !(name == "env" && strings.Contains(arg, "=")) {
+				break
+			}
+			rest = rest[1:]
+			for _, flag := range argFlags {
+				if arg == flag && len(rest) > 0 {
+					rest = rest[1:]
+					break
+				}
+			}
+		}
+		if name == "timeout" && len(rest) > 0 {
+			// timeout takes a duration before the command
+			rest = rest[1:]
+		}
+		if len(rest) == 0 {
+			return args[0]
+		}
+		args = rest
+	}
+	return nil
+}
+
+// wordText returns the literal text of a word if it has any, or else how it's written in the
+// script.
+func wordText(word *syntax.Word) string {
+	if lit := word.Lit(); lit != "" {
+		return lit
+	}
+	var str strings.Builder
+	syntax.NewPrinter().Print(&str, word)
+	return str.String()
+}
+
+// Program returns the name of the program that best characterizes the script: the first one that
+// isn't trivial (like "mkdir" or "cd"), or the first one if they're all trivial.
+func (s *Script) Program() string {
+	for _, program := range s.Programs {
+		if _, isTrivial := trivial[program]; !isTrivial {
+			return program
+		}
+	}
+	if len(s.Programs) > 0 {
+		return s.Programs[0]
+	}
+	return ""
+}
+
+// Label returns the script on a single line.
+func (s *Script) Label() string {
+	if s.File == nil {
+		return strings.Join(strings.Fields(s.Source), " ")
+	}
+	var str strings.Builder
+	syntax.NewPrinter(syntax.SingleLine(true)).Print(&str, s.File)
+	return strings.Join(strings.Fields(str.String()), " ")
+}
+
+// Highlight returns the lines of the script, split in to syntax-highlighted spans.
+func (s *Script) Highlight() [][]Span {
+	classes := make([]string, len(s.Source))
+	mark := func(start, end syntax.Pos, class string) {
+		if !start.IsValid() || !end.IsValid() {
+			return
+		}
+		for i := start.Offset(); i < end.Offset() && i < uint(len(classes)); i++ {
+			classes[i] = class
+		}
+	}
+	markLen := func(start syntax.Pos, n uint, class string) {
+		if !start.IsValid() {
+			return
+		}
+		for i := start.Offset(); i < start.Offset()+n && i < uint(len(classes)); i++ {
+			classes[i] = class
+		}
+	}
+	if s.File != nil {
+		// File doesn't have the comments; re-parse to find them.  The script parsed once, so it
+		// will again.
+		if withComments, err := syntax.NewParser(syntax.KeepComments(true), syntax.Variant(syntax.LangBash)).
+			Parse(strings.NewReader(s.Source), ""); err == nil {
+			syntax.Walk(withComments, func(node syntax.Node) bool {
+				if comment, ok := node.(*syntax.Comment); ok {
+					mark(comment.Pos(), comment.End(), "comment")
+				}
+				return true
+			})
+		}
+		syntax.Walk(s.File, func(node syntax.Node) bool {
+			switch node := node.(type) {
+			case *syntax.Stmt:
+				if node.Semicolon.IsValid() && node.Semicolon.Offset() < uint(len(s.Source)) {
+					n := uint(1)
+					if strings.HasPrefix(s.Source[node.Semicolon.Offset():], "|&") {
+						n = 2
+					}
+					markLen(node.Semicolon, n, "operator")
+				}
+			case *syntax.BinaryCmd:
+				markLen(node.OpPos, uint(len(node.Op.String())), "operator")
+			case *syntax.Assign:
+				mark(node.Pos(), node.End(), "assignment")
+			case *syntax.Redirect:
+				mark(node.Pos(), node.End(), "redirect")
+			case *syntax.Word:
+				if _, isProgram := s.programWords[node]; isProgram {
+					mark(node.Pos(), node.End(), "program")
+				}
+			case *syntax.SglQuoted, *syntax.DblQuoted:
+				mark(node.Pos(), node.End(), "string")
+			case *syntax.ParamExp, *syntax.CmdSubst, *syntax.ArithmExp:
+				mark(node.Pos(), node.End(), "expansion")
+			case *syntax.IfClause:
+				markLen(node.Position, 2, "keyword")
+				if strings.HasPrefix(s.Source[node.Position.Offset():], "else") ||
+					strings.HasPrefix(s.Source[node.Position.Offset():], "elif") {
+					markLen(node.Position, 4, "keyword")
+				}
+				markLen(node.ThenPos, 4, "keyword")
+				markLen(node.FiPos, 2, "keyword")
+			case *syntax.WhileClause:
+				markLen(node.WhilePos, 5, "keyword")
+				markLen(node.DoPos, 2, "keyword")
+				markLen(node.DonePos, 4, "keyword")
+			case *syntax.ForClause:
+				markLen(node.ForPos, 3, "keyword")
+				markLen(node.DoPos, 2, "keyword")
+				markLen(node.DonePos, 4, "keyword")
+			case *syntax.CaseClause:
+				markLen(node.Case, 4, "keyword")
+				markLen(node.In, 2, "keyword")
+				markLen(node.Esac, 4, "keyword")
+			case *syntax.Subshell:
+				markLen(node.Lparen, 1, "operator")
+				markLen(node.Rparen, 1, "operator")
+			case *syntax.Block:
+				markLen(node.Lbrace, 1, "operator")
+				markLen(node.Rbrace, 1, "operator")
+			}
+			return true
+		})
+	}
+
+	lines := [][]Span{nil}
+	for i := 0; i < len(s.Source); {
+		if s.Source[i] == '\n' {
+			lines = append(lines, nil)
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(s.Source) && s.Source[end] != '\n' && classes[end] == classes[i] {
+			end++
+		}
+		lines[len(lines)-1] = append(lines[len(lines)-1], Span{Class: classes[i], Text: s.Source[i:end]})
+		i = end
+	}
+	return lines
+}
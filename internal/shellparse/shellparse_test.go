@@ -0,0 +1,142 @@
+package shellparse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitShell(t *testing.T) {
+	testcases := []struct {
+		Args   []string
+		Shell  string
+		Script string
+	}{
+		{[]string{"/bin/sh", "-c", "echo hi"}, "/bin/sh", "echo hi"},
+		{[]string{"bash", "-ec", "echo hi"}, "bash", "echo hi"},
+		{[]string{"/bin/bash", "-e", "-c", "echo hi"}, "/bin/bash", "echo hi"},
+		{[]string{"bash", "-o", "pipefail", "-c", "a | b"}, "bash", "a | b"},
+		{[]string{"bash", "-eo", "pipefail", "-c", "a | b"}, "bash", "a | b"},
+		{[]string{"bash", "+o", "posix", "-c", "x"}, "bash", "x"},
+		{[]string{"/bin/sh", "-c"}, "", ""},
+		{[]string{"/bin/sh", "script.sh"}, "", ""},
+		{[]string{"/bin/sh", "script.sh", "-c"}, "", ""},
+		{[]string{"/bin/sh", "--norc", "-c", "x"}, "", ""},
+		{[]string{"python", "-c", "print(1)"}, "", ""},
+		{[]string{"cc", "-c", "a.c"}, "", ""},
+	}
+	for _, tc := range testcases {
+		shell, script := splitShell(tc.Args)
+		if shell != tc.Shell || script != tc.Script {
+			t.Errorf("splitShell(%q) = %q, %q; want %q, %q", tc.Args, shell, script, tc.Shell, tc.Script)
+		}
+	}
+}
+
+func TestPrograms(t *testing.T) {
+	testcases := []struct {
+		Script   string
+		Programs []string
+		Program  string
+	}{
+		{"cc -c a.c", []string{"cc"}, "cc"},
+		{"/usr/bin/cc -c a.c", []string{"cc"}, "cc"},
+		{"mkdir -p out && cc -o out/a a.c", []string{"mkdir", "cc"}, "cc"},
+		{"mkdir -p out; touch out/a", []string{"mkdir", "touch"}, "mkdir"},
+		{"FOO=1 go build ./...", []string{"go"}, "go"},
+		{"env FOO=1 BAR=2 go test", []string{"go"}, "go"},
+		{"env -u HOME -- go vet", []string{"go"}, "go"},
+		{"nice -n 10 make -C sub", []string{"make"}, "make"},
+		{"timeout -s KILL 10 ./test.sh", []string{"test.sh"}, "test.sh"},
+		{"sudo -u nobody env X=1 nice ld -o a a.o", []string{"ld"}, "ld"},
+		{"/usr/bin/time -f %e protoc --go_out=. a.proto", []string{"protoc"}, "protoc"},
+		{"time -p protoc a.proto", []string{"protoc"}, "protoc"}, // bash's time keyword
+		{"exec -a foo bar", []string{"bar"}, "bar"},
+		{"find . -name '*.o' | xargs -n 1 rm", []string{"find", "rm"}, "find"},
+		{"env", []string{"env"}, "env"},
+		{"nice -n 5", []string{"nice"}, "nice"},
+		{"if test -f a; then cp a b; fi", []string{"test", "cp"}, "cp"},
+		{"for f in *.c; do gcc -c $f; done", []string{"gcc"}, "gcc"},
+		{"$(CC) -c a.c", []string{"$(CC)", "CC"}, "$(CC)"}, // make didn't expand it
+		{"echo $(git describe)", []string{"echo", "git"}, "git"},
+		{"true", []string{"true"}, "true"},
+		{"", nil, ""},
+	}
+	for _, tc := range testcases {
+		s := ParseArgs([]string{"/bin/sh", "-c", tc.Script})
+		if !reflect.DeepEqual(s.Programs, tc.Programs) {
+			t.Errorf("%q: Programs = %q, want %q", tc.Script, s.Programs, tc.Programs)
+		}
+		if got := s.Program(); got != tc.Program {
+			t.Errorf("%q: Program() = %q, want %q", tc.Script, got, tc.Program)
+		}
+	}
+
+	// not a shell script
+	s := ParseArgs([]string{"/usr/bin/env", "FOO=1", "/usr/bin/cc", "-c", "a b.c"})
+	if want := []string{"cc"}; !reflect.DeepEqual(s.Programs, want) || s.Shell != "" {
+		t.Errorf("env cc: Shell = %q, Programs = %q; want \"\", %q", s.Shell, s.Programs, want)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	testcases := []struct {
+		Args  []string
+		Label string
+	}{
+		{[]string{"/bin/sh", "-c", "cc -c a.c"}, "cc -c a.c"},
+		{[]string{"/bin/sh", "-c", "mkdir -p out\ncc -o out/a a.c"}, "mkdir -p out; cc -o out/a a.c"},
+		{[]string{"/bin/sh", "-c", "# build it\ncc   -c a.c # quietly\n"}, "cc -c a.c"},
+		{[]string{"/bin/sh", "-c", "if [ -f a ]; then\n\tcp a b\nfi"}, "if [ -f a ]; then cp a b; fi"},
+		{[]string{"/bin/sh", "-c", "a &&\n  b"}, "a && b"},
+		{[]string{"/bin/sh", "-c", "echo 'unterminated"}, "echo 'unterminated"},
+		{[]string{"cc", "-c", "a b.c"}, "cc -c 'a b.c'"},
+	}
+	for _, tc := range testcases {
+		if got := ParseArgs(tc.Args).Label(); got != tc.Label {
+			t.Errorf("%q: Label() = %q, want %q", tc.Args, got, tc.Label)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	// Each span is written as "class:text", or just "text" for plain text; lines are separated
+	// by "\n".
+	testcases := []struct {
+		Script string
+		Spans  string
+	}{
+		{"cc -c a.c", "program:cc| -c a.c"},
+		{"FOO=1 env -u X go build >log 2>&1",
+			"assignment:FOO=1| env -u X |program:go| build |redirect:>log| |redirect:2>&1"},
+		{"a && b | c; d", "program:a| |operator:&&| |program:b| |operator:|| |program:c|operator:;| |program:d"},
+		{"echo \"$X\" 'y' $(date)",
+			"program:echo| |string:\"|expansion:$X|string:\"| |string:'y'| |expansion:$(|program:date|expansion:)"},
+		{"# comment\ncc a.c # trailing",
+			"comment:# comment\nprogram:cc| a.c |comment:# trailing"},
+		{"if true; then\n\tfalse\nfi",
+			"keyword:if| |program:true|operator:;| |keyword:then\n\t|program:false\nkeyword:fi"},
+		{"for f in a b; do x $f; done",
+			"keyword:for| f in a b; |keyword:do| |program:x| |expansion:$f|operator:;| |keyword:done"},
+		{"(cd sub && make)",
+			"operator:(|program:cd| sub |operator:&&| |program:make|operator:)"},
+		{"echo 'unterminated", "echo 'unterminated"},
+	}
+	for _, tc := range testcases {
+		var lines []string
+		for _, line := range ParseArgs([]string{"/bin/sh", "-c", tc.Script}).Highlight() {
+			var spans []string
+			for _, span := range line {
+				if span.Class == "" {
+					spans = append(spans, span.Text)
+				} else {
+					spans = append(spans, span.Class+":"+span.Text)
+				}
+			}
+			lines = append(lines, strings.Join(spans, "|"))
+		}
+		if got := strings.Join(lines, "\n"); got != tc.Spans {
+			t.Errorf("%q: Highlight() =\n\t%q\nwant\n\t%q", tc.Script, got, tc.Spans)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package visualize
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var colorSchemes = []string{
+	"none",
+	"dir",
+	"tool",
+	"status",
+	"cpu",
+	"duration",
+}
+
+type LegendEntry struct {
+	Color string
+	Label string
+}
+
+// legendColumns is how many legend entries go on each line of the legend.
+const legendColumns = 4
+
+// maxLegendEntries keeps the "dir" legend from swamping the picture in very recursive builds.
+const maxLegendEntries = 24
+
+// categoricalPalette is used for schemes where the colors don't mean anything by themselves.
+var categoricalPalette = []string{
+	"#1F77B4", "#FF7F0E", "#2CA02C", "#D62728", "#9467BD", "#8C564B",
+	"#E377C2", "#7F7F7F", "#BCBD22", "#17BECF", "#AEC7E8", "#FFBB78",
+}
+
+// heatPalette is the gradient used for the continuous schemes, from cold to hot.
+var heatPalette = [][3]float64{
+	{0x2C, 0x7B, 0xB6},
+	{0xAB, 0xD9, 0xE9},
+	{0xFF, 0xFF, 0xBF},
+	{0xFD, 0xAE, 0x61},
+	{0xD7, 0x19, 0x1C},
+}
+
+func heatColor(f float64) string {
+	if f < 0 || math.IsNaN(f) {
+		f = 0
+	}
+	if f > 1 {
+		f = 1
+	}
+	pos := f * float64(len(heatPalette)-1)
+	i := int(pos)
+	if i >= len(heatPalette)-1 {
+		i = len(heatPalette) - 2
+	}
+	frac := pos - float64(i)
+	var rgb [3]int
+	for c := range rgb {
+		rgb[c] = int(math.Round(heatPalette[i][c] + frac*(heatPalette[i+1][c]-heatPalette[i][c])))
+	}
+	return fmt.Sprintf("#%02X%02X%02X", rgb[0], rgb[1], rgb[2])
+}
+
+var toolCategories = []struct {
+	Name  string
+	Color string
+	Tools []string
+}{
+	{"compiler", "#1F77B4", []string{"cc", "c++", "gcc", "g++", "clang", "clang++", "cpp", "rustc", "javac", "tsc", "swiftc", "gfortran"}},
+	{"linker", "#9467BD", []string{"ld", "ld.lld", "ld.gold", "lld", "ar", "ranlib", "strip"}},
+	{"codegen", "#17BECF", []string{"protoc", "bison", "yacc", "flex", "lex", "m4", "swig"}},
+	{"go", "#2CA02C", []string{"go", "gofmt", "golangci-lint"}},
+	{"docker", "#D62728", []string{"docker", "docker-compose", "podman", "buildah", "kubectl", "helm"}},
+	{"make", "#7F7F7F", []string{"make", "gmake"}},
+	{"python", "#BCBD22", []string{"python", "python2", "python3", "pip", "pip3", "pytest"}},
+	{"node", "#FF7F0E", []string{"node", "npm", "npx", "yarn"}},
+	{"file utilities", "#8C564B", []string{"cp", "mv", "rm", "ln", "mkdir", "install", "touch", "cat", "sed", "awk", "tar", "gzip", "find", "echo", "printf", "test", "[", "true", "false", "sh", "bash"}},
+}
+
+const otherToolColor = "#E377C2"
+
+func toolCategory(tool string) (name, color string) {
+	for _, category := range toolCategories {
+		for _, candidate := range category.Tools {
+			if tool == candidate {
+				return category.Name, category.Color
+			}
+		}
+	}
+	return "other", otherToolColor
+}
+
+// Tool returns the name of the program that the command ran.
+func (cmd *SVGCommand) Tool() string {
+	if len(cmd.Collapsed) > 0 {
+		return cmd.Collapsed[0].Commands[0].Tool()
+	}
+	return cmd.Script().Program()
+}
+
+// CPUTime returns how much CPU time the command used.
+func (cmd *SVGCommand) CPUTime() time.Duration {
+	if len(cmd.Collapsed) > 0 {
+		var sum time.Duration
+		for _, recipe := range cmd.Collapsed {
+			for _, member := range recipe.Commands {
+				sum += member.CPUTime()
+			}
+		}
+		return sum
+	}
+	return cmd.Raw.UserTime + cmd.Raw.SystemTime
+}
+
+// ExitCode returns the command's exit code; for a band of collapsed recipes, it is the first
+// non-zero exit code of any of them.
+func (cmd *SVGCommand) ExitCode() int {
+	if len(cmd.Collapsed) > 0 {
+		for _, recipe := range cmd.Collapsed {
+			for _, member := range recipe.Commands {
+				if code := member.ExitCode(); code != 0 {
+					return code
+				}
+			}
+		}
+		return 0
+	}
+	return cmd.Raw.ExitCode
+}
+
+// TimedOut returns whether the command was killed by `run --recipe-timeout`; for a band of
+// collapsed recipes, whether any of them were.
+func (cmd *SVGCommand) TimedOut() bool {
+	if len(cmd.Collapsed) > 0 {
+		for _, recipe := range cmd.Collapsed {
+			for _, member := range recipe.Commands {
+				if member.TimedOut() {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return cmd.Raw.TimedOut
+}
+
+// Unfinished returns whether the command was still running when the build was interrupted; for a
+// band of collapsed recipes, whether any of them were.
+func (cmd *SVGCommand) Unfinished() bool {
+	if len(cmd.Collapsed) > 0 {
+		for _, recipe := range cmd.Collapsed {
+			for _, member := range recipe.Commands {
+				if member.Unfinished() {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return cmd.Raw.Unfinished
+}
+
+// colorer decides the background color of each command, and describes that in a legend.
+type colorer struct {
+	colors map[*SVGCommand]string
+	legend []LegendEntry
+}
+
+func (p *SVGProfile) walkCommands(fn func(*SVGCommand)) {
+	var walkMake func(*SVGMake)
+	walkMake = func(m *SVGMake) {
+		if m == nil {
+			return
+		}
+		for _, restart := range m.Restarts {
+			for _, recipe := range restart.Recipes {
+				for _, cmd := range recipe.Commands {
+					fn(cmd)
+					for _, submake := range cmd.SubMakes {
+						walkMake(submake)
+					}
+				}
+			}
+		}
+	}
+	walkMake(p.Make)
+}
+
+func newColorer(p *SVGProfile, scheme string) *colorer {
+	c := &colorer{
+		colors: make(map[*SVGCommand]string),
+	}
+	switch scheme {
+	case "none":
+		// leave it to the stylesheet
+	case "dir":
+		var dirs []string
+		dirColors := make(map[string]string)
+		p.walkCommands(func(cmd *SVGCommand) {
+			if _, ok := dirColors[cmd.Raw.MakeDir]; !ok {
+				dirColors[cmd.Raw.MakeDir] = ""
+				dirs = append(dirs, cmd.Raw.MakeDir)
+			}
+		})
+		sort.Strings(dirs)
+		for i, dir := range dirs {
+			dirColors[dir] = categoricalPalette[i%len(categoricalPalette)]
+			label, err := filepath.Rel(p.Make.Dir, dir)
+			if err != nil {
+				label = dir
+			}
+			c.legend = append(c.legend, LegendEntry{Color: dirColors[dir], Label: label})
+		}
+		if len(c.legend) > maxLegendEntries {
+			more := len(c.legend) - (maxLegendEntries - 1)
+			c.legend = append(c.legend[:maxLegendEntries-1], LegendEntry{Label: fmt.Sprintf("(%d more)", more)})
+		}
+		p.walkCommands(func(cmd *SVGCommand) {
+			c.colors[cmd] = dirColors[cmd.Raw.MakeDir]
+		})
+	case "tool":
+		used := make(map[string]bool)
+		p.walkCommands(func(cmd *SVGCommand) {
+			name, color := toolCategory(cmd.Tool())
+			used[name] = true
+			c.colors[cmd] = color
+		})
+		for _, category := range toolCategories {
+			if used[category.Name] {
+				c.legend = append(c.legend, LegendEntry{Color: category.Color, Label: category.Name})
+			}
+		}
+		if used["other"] {
+			c.legend = append(c.legend, LegendEntry{Color: otherToolColor, Label: "other"})
+		}
+	case "status":
+		const (
+			success    = "#2CA02C"
+			failure    = "#D62728"
+			killed     = "#FF7F0E"
+			timedOut   = "#9467BD"
+			unfinished = "#7F7F7F"
+		)
+		p.walkCommands(func(cmd *SVGCommand) {
+			switch code := cmd.ExitCode(); {
+			case cmd.Unfinished():
+				c.colors[cmd] = unfinished
+			case cmd.TimedOut():
+				c.colors[cmd] = timedOut
+			case code == 0:
+				c.colors[cmd] = success
+			case code < 0:
+				c.colors[cmd] = killed
+			default:
+				c.colors[cmd] = failure
+			}
+		})
+		c.legend = []LegendEntry{
+			{Color: success, Label: "exited 0"},
+			{Color: failure, Label: "exited non-zero"},
+			{Color: killed, Label: "killed by a signal"},
+			{Color: timedOut, Label: "timed out"},
+		}
+		if p.Interrupted {
+			c.legend = append(c.legend, LegendEntry{Color: unfinished, Label: "unfinished"})
+		}
+	case "cpu":
+		// CPU utilization, where 100% is one core fully busy.
+		utilization := make(map[*SVGCommand]float64)
+		max := 1.0
+		p.walkCommands(func(cmd *SVGCommand) {
+			wall := cmd.FinishTime().Sub(cmd.StartTime())
+			if wall <= 0 {
+				return
+			}
+			utilization[cmd] = float64(cmd.CPUTime()) / float64(wall)
+			if utilization[cmd] > max {
+				max = utilization[cmd]
+			}
+		})
+		p.walkCommands(func(cmd *SVGCommand) {
+			c.colors[cmd] = heatColor(utilization[cmd] / max)
+		})
+		for i := 0; i < len(heatPalette); i++ {
+			f := float64(i) / float64(len(heatPalette)-1)
+			c.legend = append(c.legend, LegendEntry{
+				Color: heatColor(f),
+				Label: fmt.Sprintf("%.0f%% CPU", 100*f*max),
+			})
+		}
+	case "duration":
+		// Use a log scale; build durations span many orders of magnitude.
+		var min, max time.Duration
+		p.walkCommands(func(cmd *SVGCommand) {
+			d := cmd.FinishTime().Sub(cmd.StartTime())
+			if d <= 0 {
+				return
+			}
+			if min == 0 || d < min {
+				min = d
+			}
+			if d > max {
+				max = d
+			}
+		})
+		if min == 0 || max <= min {
+			max = min + 1
+		}
+		span := math.Log(float64(max)) - math.Log(float64(min))
+		p.walkCommands(func(cmd *SVGCommand) {
+			d := cmd.FinishTime().Sub(cmd.StartTime())
+			if d < min {
+				d = min
+			}
+			c.colors[cmd] = heatColor((math.Log(float64(d)) - math.Log(float64(min))) / span)
+		})
+		for i := 0; i < len(heatPalette); i++ {
+			f := float64(i) / float64(len(heatPalette)-1)
+			d := time.Duration(math.Exp(math.Log(float64(min)) + f*span))
+			c.legend = append(c.legend, LegendEntry{
+				Color: heatColor(f),
+				Label: d.Round(time.Millisecond).String(),
+			})
+		}
+	default:
+		panic(errors.Errorf("invalid color scheme %q", scheme))
+	}
+	return c
+}
+
+// Color returns the background color for the command, or "" to use the stylesheet's.
+func (cmd *SVGCommand) Color(v *view) string {
+	if v.colors == nil {
+		return ""
+	}
+	return v.colors.colors[cmd]
+}
+
+// Legend returns the legend entries laid out in rows.
+func (p *SVGProfile) Legend(v *view) [][]LegendEntry {
+	if v.colors == nil {
+		return nil
+	}
+	var rows [][]LegendEntry
+	for i := 0; i < len(v.colors.legend); i += legendColumns {
+		end := i + legendColumns
+		if end > len(v.colors.legend) {
+			end = len(v.colors.legend)
+		}
+		rows = append(rows, v.colors.legend[i:end])
+	}
+	return rows
+}
+
+// LegendH is the height of the legend at the bottom of the profile.
+func (p *SVGProfile) LegendH(v *view) YLines {
+	return YLines(len(p.Legend(v)))
+}
@@ -1,6 +1,8 @@
 package visualize
 
 import (
+	"sort"
+
 	"github.com/pkg/errors"
 )
 
@@ -19,9 +21,12 @@ func convertProfile(rawProfile RawProfile) (*SVGProfile, error) {
 	}
 
 	return &SVGProfile{
-		StartTime:  rawProfile.StartTime,
-		FinishTime: rawProfile.FinishTime,
-		Make:       make,
+		StartTime:   rawProfile.StartTime,
+		FinishTime:  rawProfile.FinishTime,
+		Interrupted: rawProfile.Interrupted,
+		NumCPU:      rawProfile.NumCPU,
+		Samples:     rawProfile.Samples,
+		Make:        make,
 	}, nil
 }
 
@@ -31,6 +36,7 @@ func convertMake(rawCommands RawCommandList) *SVGMake {
 	}
 	svgMake := &SVGMake{
 		Dir:      rawCommands[0].MakeDir,
+		Shims:    rawCommands[0].Shim,
 		Restarts: nil,
 	}
 	for restartNum, numRestarts := uint(0), rawCommands.CountRestarts(); restartNum <= numRestarts; restartNum++ {
@@ -63,6 +69,9 @@ func convertMake(rawCommands RawCommandList) *SVGMake {
 		for _, recipe := range recipes {
 			svgRestart.Recipes = append(svgRestart.Recipes, recipe)
 		}
+		sort.Slice(svgRestart.Recipes, func(i, j int) bool {
+			return svgRestart.Recipes[i].Name < svgRestart.Recipes[j].Name
+		})
 		svgMake.Restarts = append(svgMake.Restarts, svgRestart)
 	}
 	return svgMake
@@ -75,10 +84,14 @@ func convertMakes(rawCommands RawCommandList) map[string]*SVGMake {
 	// TODO: maybe look for non-monotinic MakeRestarts?
 	sets := make(map[string]RawCommandList)
 	for _, cmd := range rawCommands {
-		if _, exists := sets[cmd.MakeDir]; !exists {
-			sets[cmd.MakeDir] = nil
+		key := cmd.MakeDir
+		if cmd.Shim {
+			key = shimsKey
+		}
+		if _, exists := sets[key]; !exists {
+			sets[key] = nil
 		}
-		sets[cmd.MakeDir] = append(sets[cmd.MakeDir], cmd)
+		sets[key] = append(sets[key], cmd)
 	}
 	makes := make(map[string]*SVGMake, len(sets))
 	for dir, cmds := range sets {
@@ -0,0 +1,135 @@
+package visualize
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var formats = []string{
+	"svg",
+	"dot",
+}
+
+// dotWriter renders a profile as a Graphviz graph: one node per recipe, and an edge from each
+// prerequisite that was made in the same make to the recipes that depend on it.  Order-only
+// prerequisites are drawn as dashed edges, and the recipe that ran a sub-make points in to the
+// sub-make's cluster with a bold edge.
+type dotWriter struct {
+	v        *view
+	w        io.Writer
+	err      error
+	nextNode int
+	nextMake int
+	edges    []string
+}
+
+func (d *dotWriter) printf(format string, args ...interface{}) {
+	if d.err != nil {
+		return
+	}
+	_, d.err = fmt.Fprintf(d.w, format, args...)
+}
+
+func dotQuote(str string) string {
+	return strconv.Quote(str)
+}
+
+func (d *dotWriter) writeMake(m *SVGMake, indent string) (cluster, firstNode string) {
+	cluster = fmt.Sprintf("cluster_%d", d.nextMake)
+	d.nextMake++
+	d.printf("%ssubgraph %s {\n", indent, cluster)
+	if m.Shims {
+		d.printf("%s\tlabel=%s;\n", indent, dotQuote("shims: "+d.v.rel(m.Dir)))
+	} else {
+		d.printf("%s\tlabel=%s;\n", indent, dotQuote("make: "+d.v.rel(m.Dir)))
+	}
+	d.printf("%s\ttooltip=%s;\n", indent, dotQuote(m.Title(d.v)))
+	var subMakes []*SVGMake
+	var subMakeParents []string
+	for _, restart := range m.Restarts {
+		restartIndent := indent + "\t"
+		if len(m.Restarts) > 1 {
+			d.printf("%ssubgraph %s_%d {\n", restartIndent, cluster, restart.RestartNum)
+			d.printf("%s\tlabel=%s;\n", restartIndent, dotQuote(fmt.Sprintf("restart %d", restart.RestartNum)))
+			restartIndent += "\t"
+		}
+		nodes := make(map[string]string, len(restart.Recipes))
+		for _, recipe := range restart.TimeSortedRecipes() {
+			node := fmt.Sprintf("n%d", d.nextNode)
+			d.nextNode++
+			nodes[recipe.Name] = node
+			if firstNode == "" {
+				firstNode = node
+			}
+			label := "(parse time)"
+			if m.Shims {
+				label = "(shimmed programs)"
+			}
+			if recipe.Name != "" {
+				label = d.v.rel(recipe.Name)
+			}
+			label += "\n" + recipe.FinishTime().Sub(recipe.StartTime()).Round(time.Millisecond).String()
+			attrs := []string{
+				"label=" + dotQuote(label),
+				"tooltip=" + dotQuote(recipe.Title(d.v)),
+			}
+			if cmds := recipe.SortedCommands(); len(cmds) > 0 && cmds[0].Color(d.v) != "" {
+				attrs = append(attrs, "fillcolor="+dotQuote(cmds[0].Color(d.v)))
+			}
+			d.printf("%s%s [%s];\n", restartIndent, node, strings.Join(attrs, ", "))
+			for _, cmd := range recipe.SortedCommands() {
+				dirs := make([]string, 0, len(cmd.SubMakes))
+				for dir := range cmd.SubMakes {
+					dirs = append(dirs, dir)
+				}
+				sort.Strings(dirs)
+				for _, dir := range dirs {
+					subMakes = append(subMakes, cmd.SubMakes[dir])
+					subMakeParents = append(subMakeParents, node)
+				}
+			}
+		}
+		for _, recipe := range restart.TimeSortedRecipes() {
+			for _, dep := range recipe.Dependencies() {
+				if depNode, ok := nodes[dep]; ok {
+					d.edges = append(d.edges, fmt.Sprintf("%s -> %s;", depNode, nodes[recipe.Name]))
+				}
+			}
+			for _, dep := range recipe.OrderOnlyDependencies() {
+				if depNode, ok := nodes[dep]; ok {
+					d.edges = append(d.edges, fmt.Sprintf("%s -> %s [style=dashed];", depNode, nodes[recipe.Name]))
+				}
+			}
+		}
+		if len(m.Restarts) > 1 {
+			d.printf("%s}\n", indent+"\t")
+		}
+	}
+	d.printf("%s}\n", indent)
+	for i, subMake := range subMakes {
+		subCluster, subFirst := d.writeMake(subMake, indent)
+		if subFirst != "" {
+			d.edges = append(d.edges, fmt.Sprintf("%s -> %s [style=bold, lhead=%s];", subMakeParents[i], subFirst, subCluster))
+		}
+	}
+	return cluster, firstNode
+}
+
+// DOT writes the profile as a Graphviz graph.
+func (p *SVGProfile) DOT(v *view, w io.Writer) error {
+	d := &dotWriter{v: v, w: w}
+	d.printf("digraph profile {\n")
+	d.printf("\tcompound=true;\n")
+	d.printf("\trankdir=LR;\n")
+	d.printf("\tnode [shape=box, style=\"rounded,filled\", fillcolor=\"#FFFFFF\"];\n")
+	d.writeMake(p.Make, "\t")
+	for _, edge := range d.edges {
+		d.printf("\t%s\n", edge)
+	}
+	d.printf("}\n")
+	return d.err
+}
@@ -0,0 +1,454 @@
+package visualize
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Filter controls which parts of a profile get rendered.  The input profile is not modified; only
+// the SVG tree that is built from it.
+type Filter struct {
+	// MinDuration hides commands that took less time than this.  With Collapse, recipes that
+	// would be hidden are merged in to bands instead, where there are enough of them in a run.
+	MinDuration time.Duration
+	// Include, if non-empty, hides commands whose target or command text doesn't match any of
+	// the globs.  Commands that contain sub-makes with included commands are kept.
+	Include []string
+	// Exclude hides commands (and any sub-makes inside of them) whose target or command text
+	// matches any of the globs.
+	Exclude []string
+	// Collapse, if non-zero, merges runs of at least this many sibling recipes that have
+	// targets with the same directory and extension in to a single aggregated band.  A run
+	// ends when none of its recipes are running and some other recipe starts.
+	Collapse int
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	topDir  string
+}
+
+// globToRegexp converts a shell-style glob to an anchored regexp.  Unlike filepath.Match, "*"
+// also matches "/", so that "*docker*" matches any command that mentions docker.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var str strings.Builder
+	str.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			str.WriteString(".*")
+		case '?':
+			str.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, errors.Errorf("invalid glob %q: unterminated '['", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			str.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			str.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			str.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	str.WriteString("$")
+	return regexp.Compile(str.String())
+}
+
+// compile checks the globs, and turns them in to regexps.
+func (f *Filter) compile() error {
+	f.include, f.exclude = nil, nil
+	for _, glob := range f.Include {
+		re, err := globToRegexp(glob)
+		if err != nil {
+			return errors.Wrap(err, "--include")
+		}
+		f.include = append(f.include, re)
+	}
+	for _, glob := range f.Exclude {
+		re, err := globToRegexp(glob)
+		if err != nil {
+			return errors.Wrap(err, "--exclude")
+		}
+		f.exclude = append(f.exclude, re)
+	}
+	return nil
+}
+
+// Apply filters the profile in-place.  The Filter itself isn't modified, so one Filter can be
+// applied to several profiles at once.
+func (f Filter) Apply(p *SVGProfile) error {
+	if p.Make == nil {
+		return nil
+	}
+	if f.include == nil && f.exclude == nil {
+		if err := f.compile(); err != nil {
+			return err
+		}
+	}
+	f.topDir = p.Make.Dir
+
+	if !f.filterMake(p.Make) {
+		return errors.New("the filters hide every command in the profile")
+	}
+	return nil
+}
+
+func (f *Filter) relTarget(target string) string {
+	if rel, err := filepath.Rel(f.topDir, target); err == nil {
+		return rel
+	}
+	return target
+}
+
+func (f *Filter) matches(patterns []*regexp.Regexp, cmd *SVGCommand) bool {
+	// Commands get matched before any of them are collapsed, so this is always the text of a
+	// real command.
+	candidates := []string{
+		cmd.Raw.RecipeTarget,
+		f.relTarget(cmd.Raw.RecipeTarget),
+		cmd.Script().Source,
+	}
+	for _, re := range patterns {
+		for _, str := range candidates {
+			if re.MatchString(str) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterMake filters the make in-place, and returns whether there's anything left of it.
+func (f *Filter) filterMake(m *SVGMake) bool {
+	restarts := m.Restarts[:0]
+	for _, restart := range m.Restarts {
+		if f.filterRestart(restart) {
+			restarts = append(restarts, restart)
+		}
+	}
+	m.Restarts = restarts
+	return len(m.Restarts) > 0
+}
+
+func (f *Filter) filterRestart(r *SVGRestart) bool {
+	recipes := r.Recipes[:0]
+	for _, recipe := range r.Recipes {
+		commands := recipe.Commands[:0]
+		for _, cmd := range recipe.Commands {
+			if f.filterCommand(cmd) {
+				commands = append(commands, cmd)
+			}
+		}
+		recipe.Commands = commands
+		if len(recipe.Commands) > 0 {
+			recipes = append(recipes, recipe)
+		}
+	}
+	r.Recipes = recipes
+	if f.Collapse > 0 {
+		f.collapseRestart(r)
+	}
+	if f.MinDuration > 0 {
+		recipes := r.Recipes[:0]
+		for _, recipe := range r.Recipes {
+			commands := recipe.Commands[:0]
+			for _, cmd := range recipe.Commands {
+				if cmd.FinishTime().Sub(cmd.StartTime()) >= f.MinDuration {
+					commands = append(commands, cmd)
+				}
+			}
+			recipe.Commands = commands
+			if len(recipe.Commands) > 0 {
+				recipes = append(recipes, recipe)
+			}
+		}
+		r.Recipes = recipes
+	}
+	return len(r.Recipes) > 0
+}
+
+func (f *Filter) filterCommand(cmd *SVGCommand) bool {
+	if len(f.exclude) > 0 && f.matches(f.exclude, cmd) {
+		return false
+	}
+	for dir, submake := range cmd.SubMakes {
+		if !f.filterMake(submake) {
+			delete(cmd.SubMakes, dir)
+		}
+	}
+	if len(f.include) > 0 && !f.matches(f.include, cmd) && len(cmd.SubMakes) == 0 {
+		return false
+	}
+	return true
+}
+
+// collapsePattern returns the name of the band that the recipe could be collapsed in to, or "" if
+// the recipe shouldn't be collapsed.
+func (f *Filter) collapsePattern(recipe *SVGRecipe) string {
+	if recipe.Name == "" {
+		return ""
+	}
+	for _, cmd := range recipe.Commands {
+		if len(cmd.SubMakes) > 0 || len(cmd.Collapsed) > 0 {
+			return ""
+		}
+		if f.MinDuration > 0 && cmd.FinishTime().Sub(cmd.StartTime()) >= f.MinDuration {
+			// big enough to be shown on its own
+			return ""
+		}
+	}
+	return filepath.Join(filepath.Dir(recipe.Name), "*"+filepath.Ext(recipe.Name))
+}
+
+// collapseRuns groups the restart's recipes by collapsePattern, and splits each group in to
+// runs: a run ends when all of its recipes have finished, and some other recipe starts before
+// the group's next one does.  So a run is a stretch of the build that the group had to itself,
+// or shared with other recipes that were running alongside it.
+func (f *Filter) collapseRuns(r *SVGRestart) (patterns []string, runs map[string][][]*SVGRecipe) {
+	starts := make([]time.Time, 0, len(r.Recipes))
+	groups := make(map[string][]*SVGRecipe)
+	for _, recipe := range r.Recipes {
+		starts = append(starts, recipe.StartTime())
+		if pattern := f.collapsePattern(recipe); pattern != "" {
+			groups[pattern] = append(groups[pattern], recipe)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	// startedBetween returns whether any of the restart's recipes started after a and before b.
+	startedBetween := func(a, b time.Time) bool {
+		i := sort.Search(len(starts), func(i int) bool { return starts[i].After(a) })
+		return i < len(starts) && starts[i].Before(b)
+	}
+
+	runs = make(map[string][][]*SVGRecipe, len(groups))
+	for pattern, members := range groups {
+		patterns = append(patterns, pattern)
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].StartTime().Before(members[j].StartTime())
+		})
+		var run []*SVGRecipe
+		var runFinish time.Time
+		for _, member := range members {
+			// Earlier members all started before this one, and later ones at the same
+			// time or after, so any recipe that started in the gap isn't a member.
+			if start := member.StartTime(); len(run) > 0 && start.After(runFinish) && startedBetween(runFinish, start) {
+				runs[pattern] = append(runs[pattern], run)
+				run = nil
+			}
+			run = append(run, member)
+			if finish := member.FinishTime(); finish.After(runFinish) {
+				runFinish = finish
+			}
+		}
+		runs[pattern] = append(runs[pattern], run)
+	}
+	sort.Strings(patterns)
+	return patterns, runs
+}
+
+func (f *Filter) collapseRestart(r *SVGRestart) {
+	patterns, runs := f.collapseRuns(r)
+
+	renames := make(map[string]string)
+	bandsByName := make(map[string]*SVGRecipe)
+	var bands []*SVGRecipe
+	for _, pattern := range patterns {
+		for _, members := range runs[pattern] {
+			if len(members) < f.Collapse {
+				continue
+			}
+			// If the pattern has several runs, they each need a name of their own to
+			// be depended on by.
+			name := pattern
+			for n := 2; bandsByName[name] != nil; n++ {
+				name = fmt.Sprintf("%s (%d)", pattern, n)
+			}
+			band := &SVGRecipe{
+				Parent: r,
+				Name:   name,
+			}
+			cmd := &SVGCommand{
+				Parent:    band,
+				Collapsed: members,
+			}
+			cmd.Raw.StartTime = members[0].StartTime()
+			cmd.Raw.FinishTime = members[0].FinishTime()
+			cmd.Raw.MakeLevel = members[0].Commands[0].Raw.MakeLevel
+			cmd.Raw.MakeRestarts = members[0].Commands[0].Raw.MakeRestarts
+			cmd.Raw.MakeDir = members[0].Commands[0].Raw.MakeDir
+			cmd.Raw.RecipeTarget = pattern
+			for _, member := range members {
+				if start := member.StartTime(); start.Before(cmd.Raw.StartTime) {
+					cmd.Raw.StartTime = start
+				}
+				if finish := member.FinishTime(); finish.After(cmd.Raw.FinishTime) {
+					cmd.Raw.FinishTime = finish
+				}
+				renames[member.Name] = name
+			}
+			band.Commands = []*SVGCommand{cmd}
+			bandsByName[name] = band
+			bands = append(bands, band)
+		}
+	}
+	if len(bands) == 0 {
+		return
+	}
+
+	// Point dependencies on collapsed recipes at the band instead, and give each band the
+	// union of its members' dependencies.
+	recipes := r.Recipes[:0]
+	for _, recipe := range r.Recipes {
+		for _, cmd := range recipe.Commands {
+			cmd.Raw.RecipeDependencies = renameDependencies(cmd.Raw.RecipeDependencies, renames, renames[recipe.Name])
+			cmd.Raw.RecipeOrderOnlyDependencies = renameDependencies(cmd.Raw.RecipeOrderOnlyDependencies, renames, renames[recipe.Name])
+		}
+		if name, collapsed := renames[recipe.Name]; collapsed {
+			band := bandsByName[name]
+			for _, cmd := range recipe.Commands {
+				band.Commands[0].Raw.RecipeDependencies = append(band.Commands[0].Raw.RecipeDependencies, cmd.Raw.RecipeDependencies...)
+				band.Commands[0].Raw.RecipeOrderOnlyDependencies = append(band.Commands[0].Raw.RecipeOrderOnlyDependencies, cmd.Raw.RecipeOrderOnlyDependencies...)
+			}
+			continue
+		}
+		recipes = append(recipes, recipe)
+	}
+	for _, band := range bands {
+		cmd := band.Commands[0]
+		cmd.Raw.RecipeDependencies = renameDependencies(cmd.Raw.RecipeDependencies, nil, "")
+		cmd.Raw.RecipeOrderOnlyDependencies = renameDependencies(cmd.Raw.RecipeOrderOnlyDependencies, nil, "")
+		recipes = append(recipes, band)
+	}
+	r.Recipes = recipes
+	dropBandCycles(r.Recipes, bandsByName)
+}
+
+// dropBandCycles removes the dependencies of and on bands that would close a dependency cycle.
+// Make's own dependency graph doesn't have any cycles, but merging recipes can make one: if a.o
+// depends on gen.h, and gen.h depends on b.o, then a band of a.o and b.o both depends on gen.h and
+// is depended on by it.  Dependencies that agree with when the recipes ran (the dependency
+// finished before the recipe started) are kept in preference to ones that don't.
+func dropBandCycles(recipes []*SVGRecipe, bands map[string]*SVGRecipe) {
+	byName := make(map[string]*SVGRecipe, len(recipes))
+	for _, recipe := range recipes {
+		byName[recipe.Name] = recipe
+	}
+	type edge struct {
+		recipe, dep *SVGRecipe
+	}
+	agrees := func(e edge) bool {
+		return !e.dep.FinishTime().After(e.recipe.StartTime())
+	}
+
+	// Edges between recipes that weren't collapsed are make's own, so they can all go in
+	// first; it's the rest that might close a cycle.
+	deps := make(map[*SVGRecipe][]*SVGRecipe, len(recipes))
+	var bandEdges []edge
+	for _, recipe := range recipes {
+		for _, name := range append(recipe.Dependencies(), recipe.OrderOnlyDependencies()...) {
+			dep, ok := byName[name]
+			if !ok {
+				continue
+			}
+			if bands[recipe.Name] == nil && bands[dep.Name] == nil {
+				deps[recipe] = append(deps[recipe], dep)
+			} else {
+				bandEdges = append(bandEdges, edge{recipe, dep})
+			}
+		}
+	}
+	sort.SliceStable(bandEdges, func(i, j int) bool {
+		return agrees(bandEdges[i]) && !agrees(bandEdges[j])
+	})
+
+	// dependsOn returns whether a depends on b, directly or indirectly, through the edges that
+	// have been kept so far.
+	dependsOn := func(a, b *SVGRecipe) bool {
+		seen := make(map[*SVGRecipe]bool)
+		stack := []*SVGRecipe{a}
+		for len(stack) > 0 {
+			recipe := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if recipe == b {
+				return true
+			}
+			if seen[recipe] {
+				continue
+			}
+			seen[recipe] = true
+			stack = append(stack, deps[recipe]...)
+		}
+		return false
+	}
+	drop := make(map[*SVGRecipe]map[string]bool)
+	for _, e := range bandEdges {
+		if dependsOn(e.dep, e.recipe) {
+			if drop[e.recipe] == nil {
+				drop[e.recipe] = make(map[string]bool)
+			}
+			drop[e.recipe][e.dep.Name] = true
+			continue
+		}
+		deps[e.recipe] = append(deps[e.recipe], e.dep)
+	}
+	for recipe, names := range drop {
+		for _, cmd := range recipe.Commands {
+			cmd.Raw.RecipeDependencies = withoutDependencies(cmd.Raw.RecipeDependencies, names)
+			cmd.Raw.RecipeOrderOnlyDependencies = withoutDependencies(cmd.Raw.RecipeOrderOnlyDependencies, names)
+		}
+	}
+}
+
+// withoutDependencies returns a copy of deps, leaving out the ones in drop.
+func withoutDependencies(deps []string, drop map[string]bool) []string {
+	var ret []string
+	for _, dep := range deps {
+		if !drop[dep] {
+			ret = append(ret, dep)
+		}
+	}
+	return ret
+}
+
+// renameDependencies returns a de-duplicated copy of deps with renames applied, leaving out any
+// dependency that gets renamed to self.
+func renameDependencies(deps []string, renames map[string]string, self string) []string {
+	seen := make(map[string]struct{}, len(deps))
+	var ret []string
+	for _, dep := range deps {
+		if renamed, ok := renames[dep]; ok {
+			dep = renamed
+		}
+		if _, dup := seen[dep]; dup || (self != "" && dep == self) {
+			continue
+		}
+		seen[dep] = struct{}{}
+		ret = append(ret, dep)
+	}
+	return ret
+}
+
+// CollapsedText is the label for a band of collapsed recipes.
+func (cmd *SVGCommand) CollapsedText(v *view) string {
+	var total time.Duration
+	for _, recipe := range cmd.Collapsed {
+		for _, member := range recipe.Commands {
+			total += member.FinishTime().Sub(member.StartTime())
+		}
+	}
+	return fmt.Sprintf("%d × %s (total %s)", len(cmd.Collapsed), v.rel(cmd.Raw.RecipeTarget), total.Round(time.Millisecond))
+}
@@ -0,0 +1,356 @@
+package visualize
+
+import (
+	"sort"
+)
+
+// A Layout decides where everything goes on the timeline.
+//
+// A layout arranges the profile in to a tree of Boxes, each placed within its parent; the renderer
+// then just draws that tree.  The boxes don't have to follow the shape of the make tree: a layout
+// can leave elements out, or group them in to boxes of its own.
+type Layout interface {
+	// Name is what --layout calls the layout.
+	Name() string
+	// Caption says what the X axis measures.
+	Caption() string
+	// Place lays out the profile, and returns the box for the whole timeline.  The timeline's
+	// X and Y are ignored.
+	Place(v *view, p *SVGProfile) *Box
+}
+
+// A Box is where an element is drawn.  X and W are in the same units as the parent box's W, and
+// measured from the parent box's left edge; Y and H are in lines, measured from the parent box's
+// top edge.
+type Box struct {
+	Element  SVGElement
+	X        XDuration
+	W        XDuration
+	Y        YLines
+	H        YLines
+	Children []*Box
+}
+
+// WriteSVG draws the box (and its children) in a parent box that is parentW wide.
+func (b *Box) WriteSVG(v *view, w *svgWriter, parentW XDuration) {
+	b.Element.WriteSVG(v, w, b, parentW)
+}
+
+// writeChildren draws the box's children in it.
+func (b *Box) writeChildren(v *view, w *svgWriter) {
+	for _, child := range b.Children {
+		child.WriteSVG(v, w, b.W)
+	}
+}
+
+// find returns the X position of the element's box, measured from the left edge of b.
+func (b *Box) find(e SVGElement) (XDuration, bool) {
+	for _, child := range b.Children {
+		if child.Element == e {
+			return child.X, true
+		}
+		if x, ok := child.find(e); ok {
+			return child.X + x, true
+		}
+	}
+	return 0, false
+}
+
+// extent is how far the right edge of the rightmost of the boxes is from their parent's left edge.
+func extent(boxes []*Box) XDuration {
+	var max XDuration
+	for _, box := range boxes {
+		if end := box.X + box.W; end > max {
+			max = end
+		}
+	}
+	return max
+}
+
+// A wallclockAligned Layout is one whose timeline's X is wall-clock time since the build started,
+// so that other things that were recorded during the build (see SampleTracks) can be drawn lined
+// up with it.
+type wallclockAligned interface {
+	wallclockAligned()
+}
+
+// allLayouts are the layouts that can be chosen with --layout.
+var allLayouts = []Layout{
+	wallclockLayout{},
+	compactLayout{},
+	lanesLayout{},
+	dirsLayout{},
+}
+
+func layoutNames() []string {
+	names := make([]string, 0, len(allLayouts))
+	for _, layout := range allLayouts {
+		names = append(names, layout.Name())
+	}
+	return names
+}
+
+func lookupLayout(name string) Layout {
+	for _, layout := range allLayouts {
+		if layout.Name() == name {
+			return layout
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// A nestedLayout draws the make tree as nested boxes: each make contains its restarts, each
+// restart its recipes, each recipe its commands, and each command the sub-makes that it ran.
+// Commands are placed within their recipe, and sub-makes within their command, by when they
+// started; the nested layouts differ in how they place the rest, and in how wide that makes
+// everything.
+type nestedLayout interface {
+	// placeTop sets the X of the top-level make within the timeline, and returns the width of
+	// the timeline.
+	placeTop(v *view, p *SVGProfile, m *Box) XDuration
+	// placeRestarts sets the X of each of a make's restarts.
+	placeRestarts(v *view, m *SVGMake, restarts []*Box)
+	// placeRecipes sets the X of each of a restart's recipes; byName finds the box of each
+	// of the restart's recipes by target name.
+	placeRecipes(v *view, r *SVGRestart, recipes []*Box, byName recipeBoxes)
+	// width returns the width of the element, given its children's boxes, already placed.
+	width(v *view, e SVGElement, children []*Box) XDuration
+}
+
+// A flattener is a nestedLayout that draws some sub-makes somewhere other than inside of the
+// command that ran them.
+type flattener interface {
+	flattens(m *SVGMake) bool
+}
+
+// placeNested is the Place method of a nestedLayout.
+func placeNested(l nestedLayout, v *view, p *SVGProfile) *Box {
+	top := placeMake(l, v, p.Make)
+	timeline := &Box{
+		H:        top.H,
+		Children: []*Box{top},
+	}
+	timeline.W = l.placeTop(v, p, top)
+	return timeline
+}
+
+func placeMake(l nestedLayout, v *view, m *SVGMake) *Box {
+	box := &Box{Element: m}
+	for _, restart := range m.Restarts {
+		child := placeRestart(l, v, restart)
+		if child.H > box.H {
+			box.H = child.H
+		}
+		box.Children = append(box.Children, child)
+	}
+	l.placeRestarts(v, m, box.Children)
+	box.W = l.width(v, m, box.Children)
+	return box
+}
+
+func placeRestart(l nestedLayout, v *view, r *SVGRestart) *Box {
+	box := &Box{Element: r}
+	byName := make(recipeBoxes, len(r.Recipes))
+	for _, recipe := range r.Recipes {
+		child := placeRecipe(l, v, recipe)
+		byName.add(child)
+		// TODO: Somehow also get recipe.AlsoMakes, not just recipe.Name
+		box.Children = append(box.Children, child)
+	}
+	l.placeRecipes(v, r, box.Children, byName)
+	box.H = packRecipes(v, box.Children, byName)
+	box.W = l.width(v, r, box.Children)
+	// draw them in the order that they started in
+	sort.SliceStable(box.Children, func(i, j int) bool {
+		return v.startTime(box.Children[i].Element).Before(v.startTime(box.Children[j].Element))
+	})
+	return box
+}
+
+func placeRecipe(l nestedLayout, v *view, recipe *SVGRecipe) *Box {
+	box := &Box{Element: recipe}
+	for _, cmd := range recipe.SortedCommands() {
+		box.Children = append(box.Children, placeCommand(l, v, cmd))
+	}
+	start := v.startTime(recipe)
+	if v.VerboseCommand {
+		// one command under the other
+		var yoff YLines
+		for _, child := range box.Children {
+			child.X = XDuration(v.startTime(child.Element).Sub(start))
+			child.Y = yoff
+			yoff += child.H
+		}
+		box.H = yoff
+	} else {
+		// commands that ran one after the other go on the same line
+		var xCursor XDuration
+		var yCursor YLines
+		var yPending YLines
+		for _, child := range box.Children {
+			child.X = XDuration(v.startTime(child.Element).Sub(start))
+			if child.X > xCursor {
+				if child.H > yPending {
+					yPending = child.H
+				}
+			} else {
+				yCursor += yPending
+				yPending = child.H
+			}
+			child.Y = yCursor
+		}
+		box.H = yCursor + yPending
+	}
+	box.W = l.width(v, recipe, box.Children)
+	return box
+}
+
+func placeCommand(l nestedLayout, v *view, cmd *SVGCommand) *Box {
+	box := &Box{Element: cmd}
+	box.H = cmd.BaseH(v)
+	for _, submake := range cmd.SortedSubMakes() {
+		if f, ok := l.(flattener); ok && f.flattens(submake) {
+			continue
+		}
+		child := placeMake(l, v, submake)
+		child.X = XDuration(v.startTime(submake).Sub(v.startTime(cmd)))
+		child.Y = box.H
+		box.H += child.H
+		box.Children = append(box.Children, child)
+	}
+	box.W = l.width(v, cmd, box.Children)
+	return box
+}
+
+// wallW is the width of the element in a layout where widths are wall-clock time.
+func wallW(v *view, e SVGElement) XDuration {
+	return XDuration(v.finishTime(e).Sub(v.startTime(e)))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// recipeBoxes finds recipes' boxes by target name.  Make only knows about dependencies between
+// the recipes of one make and restart, and different makes (or restarts) can have recipes for
+// the same target, so the name is looked up in the same restart as the recipe that depends on it.
+type recipeBoxes map[recipeKey]*Box
+
+type recipeKey struct {
+	Restart *SVGRestart
+	Name    string
+}
+
+func (boxes recipeBoxes) add(box *Box) {
+	recipe := box.Element.(*SVGRecipe)
+	boxes[recipeKey{Restart: recipe.Parent, Name: recipe.Name}] = box
+}
+
+// dependencyBoxes returns the boxes of the recipes (from the same restart) that the recipe had to
+// wait for, including order-only prerequisites, and the "" recipe (parse-time commands) as a
+// pseudo-dependency.
+func dependencyBoxes(recipe *SVGRecipe, byName recipeBoxes) []*Box {
+	depNames := append(recipe.Dependencies(), recipe.OrderOnlyDependencies()...)
+	if recipe.Name != "" {
+		// include "" (parse-time commands) as a pseudo-dependency
+		depNames = append(depNames, "")
+	}
+	var ret []*Box
+	for _, depName := range depNames {
+		if dep, ok := byName[recipeKey{Restart: recipe.Parent, Name: depName}]; ok {
+			ret = append(ret, dep)
+		}
+	}
+	return ret
+}
+
+// packRecipes sets the Y of each of a restart's recipes, once their X has been set, and returns
+// how many lines tall that makes the restart.
+//
+// This is first-fit interval packing: place the recipes in order of their X position, each one on
+// the lowest rows that are free at that X.  For recipes that are 1 line tall this uses exactly as
+// many rows as the peak concurrency; taller recipes (ones with sub-makes) may leave some gaps.
+func packRecipes(v *view, recipes []*Box, byName recipeBoxes) YLines {
+	sorted := append([]*Box(nil), recipes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].X == sorted[j].X {
+			// as a tie-breaker, list the wider one first
+			return sorted[i].W > sorted[j].W
+		}
+		return sorted[i].X < sorted[j].X
+	})
+	var rows rowSet
+	placed := make(map[*Box]bool, len(recipes))
+	for _, box := range sorted {
+		y, ok := YLines(0), false
+		if v.PackAdjacent {
+			if dep := criticalDependency(box, byName, placed); dep != nil {
+				y = dep.Y
+				ok = rows.available(box.X, y, box.H)
+			}
+		}
+		if !ok {
+			y = rows.firstFit(box.X, box.H)
+		}
+		rows.add(box.X, y, box.W, box.H)
+		box.Y = y
+		placed[box] = true
+	}
+	return YLines(len(rows))
+}
+
+// criticalDependency returns the (already placed) dependency that finished last before the recipe
+// started; the one that the recipe was actually waiting on.
+func criticalDependency(box *Box, byName recipeBoxes, placed map[*Box]bool) *Box {
+	var ret *Box
+	var retEnd XDuration
+	for _, dep := range dependencyBoxes(box.Element.(*SVGRecipe), byName) {
+		if !placed[dep] {
+			continue
+		}
+		if end := dep.X + dep.W; end <= box.X && (ret == nil || end > retEnd) {
+			ret = dep
+			retEnd = end
+		}
+	}
+	return ret
+}
+
+// rowSet tracks, for each row, where the last thing placed in it ends.
+type rowSet []XDuration
+
+func (rows *rowSet) add(x XDuration, y YLines, w XDuration, h YLines) {
+	for YLines(len(*rows)) < y+h {
+		*rows = append(*rows, 0)
+	}
+	for iy := y; iy < y+h; iy++ {
+		if (*rows)[iy] < x+w {
+			(*rows)[iy] = x + w
+		}
+	}
+}
+
+func (rows rowSet) available(x XDuration, y YLines, h YLines) bool {
+	for iy := y; iy < y+h; iy++ {
+		if iy < YLines(len(rows)) && rows[iy] > x {
+			return false
+		}
+	}
+	return true
+}
+
+// firstFit returns the lowest Y at which there are h consecutive rows that are free at x.
+func (rows rowSet) firstFit(x XDuration, h YLines) YLines {
+	var run YLines
+	for iy, rowEnd := range rows {
+		if rowEnd > x {
+			run = 0
+			continue
+		}
+		run++
+		if run == h {
+			return YLines(iy) - h + 1
+		}
+	}
+	return YLines(len(rows)) - run
+}
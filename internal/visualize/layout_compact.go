@@ -0,0 +1,77 @@
+package visualize
+
+// compactLayout places each recipe as soon after its dependencies as possible, as if the
+// build had had unlimited parallelism and no overhead, so the X axis is time accumulated along
+// dependency chains.  Time that commands spent waiting on a sub-make is compacted along with the
+// sub-make.
+type compactLayout struct{}
+
+func (compactLayout) Name() string { return "compact" }
+
+func (compactLayout) Caption() string { return "accumulated time along dependency chains" }
+
+func (l compactLayout) Place(v *view, p *SVGProfile) *Box { return placeNested(l, v, p) }
+
+func (compactLayout) placeTop(v *view, p *SVGProfile, m *Box) XDuration {
+	m.X = 0
+	return m.W
+}
+
+// placeRestarts puts the restarts one after the other.
+func (compactLayout) placeRestarts(v *view, m *SVGMake, restarts []*Box) {
+	var xoff XDuration
+	for _, box := range restarts {
+		box.X = xoff
+		xoff += box.W
+	}
+}
+
+// placeRecipes puts each recipe right after the last of its dependencies to finish.
+func (compactLayout) placeRecipes(v *view, r *SVGRestart, recipes []*Box, byName recipeBoxes) {
+	solved := make(map[*Box]bool, len(recipes))
+	var solveX func(box *Box) XDuration
+	solveX = func(box *Box) XDuration {
+		if !solved[box] {
+			var max XDuration
+			for _, dep := range dependencyBoxes(box.Element.(*SVGRecipe), byName) {
+				if depOffset := solveX(dep) + dep.W; depOffset > max {
+					max = depOffset
+				}
+			}
+			box.X = max
+			solved[box] = true
+		}
+		return box.X
+	}
+	for _, box := range recipes {
+		solveX(box)
+	}
+}
+
+func (compactLayout) width(v *view, e SVGElement, children []*Box) XDuration {
+	switch e := e.(type) {
+	case *SVGMake, *SVGRestart:
+		return extent(children)
+	case *SVGRecipe:
+		if e.Parent != nil && e.Parent.Parent.Shims {
+			// There are no dependencies to compact the shimmed programs by.
+			return wallW(v, e)
+		}
+		var max XDuration
+		for _, child := range children {
+			if child.W > max {
+				max = child.W
+			}
+		}
+		return max
+	case *SVGCommand:
+		if len(children) == 1 {
+			// compact the time spent waiting on the sub-make along with it
+			sub := children[0]
+			return sub.W + (wallW(v, e) - wallW(v, sub.Element))
+		}
+		return wallW(v, e)
+	default:
+		return wallW(v, e)
+	}
+}
@@ -0,0 +1,133 @@
+package visualize
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// dirsLayout gives each directory that make ran in a band of its own, across the whole recursive
+// build, on a wall-clock axis; so each sub-project's band shows when it was being built.  The
+// recipes in each band are placed just like the wallclock layout places them, except that
+// sub-makes are drawn in their own directory's band instead of inside of the command that ran
+// them.  Programs that ran through `run --shim` wrappers are still drawn inside of their command.
+type dirsLayout struct {
+	wallclockLayout
+}
+
+func (dirsLayout) Name() string { return "dirs" }
+
+func (dirsLayout) Caption() string {
+	return "wall-clock time since the build started, with one band per directory"
+}
+
+func (dirsLayout) flattens(m *SVGMake) bool {
+	return !m.Shims
+}
+
+func (l dirsLayout) Place(v *view, p *SVGProfile) *Box {
+	bandsByDir := make(map[string]*SVGBand)
+	var bands []*SVGBand
+	var walk func(m *SVGMake)
+	walk = func(m *SVGMake) {
+		if m == nil || m.Shims {
+			return
+		}
+		band, ok := bandsByDir[m.Dir]
+		if !ok {
+			band = &SVGBand{Dir: m.Dir}
+			bandsByDir[m.Dir] = band
+			bands = append(bands, band)
+		}
+		for _, restart := range m.Restarts {
+			band.Recipes = append(band.Recipes, restart.Recipes...)
+			for _, recipe := range restart.Recipes {
+				for _, cmd := range recipe.Commands {
+					for _, submake := range cmd.SortedSubMakes() {
+						walk(submake)
+					}
+				}
+			}
+		}
+	}
+	walk(p.Make)
+	// top to bottom in the order that they started building in
+	sort.SliceStable(bands, func(i, j int) bool {
+		return v.startTime(bands[i]).Before(v.startTime(bands[j]))
+	})
+
+	timeline := &Box{W: XDuration(p.Duration())}
+	for _, band := range bands {
+		box := &Box{
+			Element: band,
+			W:       timeline.W,
+			Y:       timeline.H,
+		}
+		byName := make(recipeBoxes, len(band.Recipes))
+		for _, recipe := range band.Recipes {
+			child := placeRecipe(l, v, recipe)
+			child.X = XDuration(v.startTime(recipe).Sub(p.StartTime))
+			byName.add(child)
+			box.Children = append(box.Children, child)
+		}
+		box.H = packRecipes(v, box.Children, byName)
+		// leave the first line for the label
+		for _, child := range box.Children {
+			child.Y++
+		}
+		box.H++
+		sort.SliceStable(box.Children, func(i, j int) bool {
+			return v.startTime(box.Children[i].Element).Before(v.startTime(box.Children[j].Element))
+		})
+		timeline.H += box.H
+		timeline.Children = append(timeline.Children, box)
+	}
+	return timeline
+}
+
+// SVGBand is a band of the dirs layout: all of the recipes that make ran in one directory, from
+// however many makes.
+type SVGBand struct {
+	Dir     string
+	Recipes []*SVGRecipe
+}
+
+func (band *SVGBand) StartTime() time.Time {
+	var min time.Time
+	for i, recipe := range band.Recipes {
+		if start := recipe.StartTime(); i == 0 || start.Before(min) {
+			min = start
+		}
+	}
+	return min
+}
+
+func (band *SVGBand) FinishTime() time.Time {
+	var max time.Time
+	for _, recipe := range band.Recipes {
+		if finish := recipe.FinishTime(); finish.After(max) {
+			max = finish
+		}
+	}
+	return max
+}
+
+func (band *SVGBand) Title(v *view) string {
+	start := v.startTime(band).Sub(v.profile.StartTime)
+	finish := v.finishTime(band).Sub(v.profile.StartTime)
+	return fmt.Sprintf("Dir: %q\n"+
+		"Recipes: %d\n"+
+		"Building: from %s to %s (%s)",
+		v.rel(band.Dir),
+		len(band.Recipes),
+		start.Round(time.Millisecond),
+		finish.Round(time.Millisecond),
+		(finish - start).Round(time.Millisecond))
+}
+
+func (band *SVGBand) WriteSVG(v *view, w *svgWriter, box *Box, parentW XDuration) {
+	w.openBox("band", box, parentW, band.Title(v), "")
+	w.printf(`<text class="label" x="0" y="0" dx="2" dominant-baseline="hanging">%s</text>`+"\n", esc(v.rel(band.Dir)))
+	box.writeChildren(v, w)
+	w.closeBox()
+}
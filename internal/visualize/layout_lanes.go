@@ -0,0 +1,139 @@
+package visualize
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// lanesLayout draws the build the way that a profiler's per-thread view draws a program: each
+// row is a job slot, and each command goes in the lowest slot that was free when it started.
+// So there are as many rows as the most commands that ever ran at once, and the gaps in the rows
+// are time that a job slot sat idle.
+//
+// A command that ran a sub-make hands its job slot to the sub-make, so it isn't drawn itself;
+// the commands that the sub-make ran are.  The programs that a command ran through `run --shim`
+// wrappers ran in the command's job slot, so they aren't drawn either.
+type lanesLayout struct{}
+
+func (lanesLayout) Name() string { return "lanes" }
+
+func (lanesLayout) Caption() string {
+	return "wall-clock time since the build started, with one row per job slot"
+}
+
+func (lanesLayout) wallclockAligned() {}
+
+func (lanesLayout) Place(v *view, p *SVGProfile) *Box {
+	var cmds []*SVGCommand
+	p.walkCommands(func(cmd *SVGCommand) {
+		if !cmd.RanMake() {
+			cmds = append(cmds, cmd)
+		}
+	})
+	sort.SliceStable(cmds, func(i, j int) bool {
+		if !cmds[i].StartTime().Equal(cmds[j].StartTime()) {
+			return cmds[i].StartTime().Before(cmds[j].StartTime())
+		}
+		if !cmds[i].FinishTime().Equal(cmds[j].FinishTime()) {
+			return cmds[i].FinishTime().Before(cmds[j].FinishTime())
+		}
+		return cmds[i].Raw.RecipeTarget < cmds[j].Raw.RecipeTarget
+	})
+
+	timeline := &Box{W: XDuration(p.Duration())}
+	var lanes []*SVGLane
+	var free []time.Time // when each lane's last command finished
+	for _, cmd := range cmds {
+		i := 0
+		for i < len(lanes) && free[i].After(cmd.StartTime()) {
+			i++
+		}
+		if i == len(lanes) {
+			lanes = append(lanes, &SVGLane{Num: i + 1})
+			free = append(free, time.Time{})
+			timeline.Children = append(timeline.Children, &Box{Element: lanes[i], W: timeline.W})
+		}
+		lanes[i].Commands = append(lanes[i].Commands, cmd)
+		free[i] = cmd.FinishTime()
+	}
+	for i, lane := range lanes {
+		box := timeline.Children[i]
+		box.Y = timeline.H
+		box.H = 1
+		for _, cmd := range lane.Commands {
+			child := &Box{
+				Element: cmd,
+				X:       XDuration(cmd.StartTime().Sub(p.StartTime)),
+				W:       wallW(v, cmd),
+				H:       cmd.BaseH(v),
+			}
+			if child.H > box.H {
+				box.H = child.H
+			}
+			box.Children = append(box.Children, child)
+		}
+		timeline.H += box.H
+	}
+	return timeline
+}
+
+// RanMake returns whether the command ran a sub-make (not counting shimmed programs).
+func (cmd *SVGCommand) RanMake() bool {
+	for _, submake := range cmd.SubMakes {
+		if !submake.Shims {
+			return true
+		}
+	}
+	return false
+}
+
+// SVGLane is a row of the lanes layout: one job slot, and the commands that ran in it, one after
+// the other.
+type SVGLane struct {
+	Num      int
+	Commands []*SVGCommand
+}
+
+func (lane *SVGLane) StartTime() time.Time {
+	if len(lane.Commands) == 0 {
+		return time.Time{}
+	}
+	return lane.Commands[0].StartTime()
+}
+
+func (lane *SVGLane) FinishTime() time.Time {
+	var max time.Time
+	for _, cmd := range lane.Commands {
+		if cmd.FinishTime().After(max) {
+			max = cmd.FinishTime()
+		}
+	}
+	return max
+}
+
+// Busy returns how long there was a command running in the job slot.
+func (lane *SVGLane) Busy() time.Duration {
+	var sum time.Duration
+	for _, cmd := range lane.Commands {
+		sum += cmd.FinishTime().Sub(cmd.StartTime())
+	}
+	return sum
+}
+
+func (lane *SVGLane) Title(v *view) string {
+	busy := lane.Busy()
+	return fmt.Sprintf("Job slot %d\n"+
+		"Commands: %d\n"+
+		"Busy: %s (%.0f%% of the build)",
+		lane.Num,
+		len(lane.Commands),
+		busy.Round(time.Millisecond),
+		100*float64(busy)/float64(v.profile.Duration()))
+}
+
+func (lane *SVGLane) WriteSVG(v *view, w *svgWriter, box *Box, parentW XDuration) {
+	w.openBox("lane", box, parentW, lane.Title(v), "")
+	box.writeChildren(v, w)
+	w.closeBox()
+}
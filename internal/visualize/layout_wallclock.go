@@ -0,0 +1,35 @@
+package visualize
+
+// wallclockLayout places everything at the time that it ran; widths are wall-clock time.
+type wallclockLayout struct{}
+
+func (wallclockLayout) Name() string { return "wallclock" }
+
+func (wallclockLayout) Caption() string { return "wall-clock time since the build started" }
+
+func (wallclockLayout) wallclockAligned() {}
+
+func (l wallclockLayout) Place(v *view, p *SVGProfile) *Box { return placeNested(l, v, p) }
+
+func (wallclockLayout) placeTop(v *view, p *SVGProfile, m *Box) XDuration {
+	m.X = XDuration(v.startTime(p.Make).Sub(p.StartTime))
+	return XDuration(p.Duration())
+}
+
+func (wallclockLayout) placeRestarts(v *view, m *SVGMake, restarts []*Box) {
+	start := v.startTime(m)
+	for _, box := range restarts {
+		box.X = XDuration(v.startTime(box.Element).Sub(start))
+	}
+}
+
+func (wallclockLayout) placeRecipes(v *view, r *SVGRestart, recipes []*Box, byName recipeBoxes) {
+	start := v.startTime(r)
+	for _, box := range recipes {
+		box.X = XDuration(v.startTime(box.Element).Sub(start))
+	}
+}
+
+func (wallclockLayout) width(v *view, e SVGElement, children []*Box) XDuration {
+	return wallW(v, e)
+}
@@ -1,13 +1,13 @@
 package visualize
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
+
+	"github.com/datawire/profile-make/internal/protocol"
 )
 
 func inArray(needle string, haystack []string) bool {
@@ -20,44 +20,34 @@ func inArray(needle string, haystack []string) bool {
 }
 
 func Main(args ...string) error {
-	layouts := []string{
-		"wallclock",
-		"compact",
-	}
 	argparser := pflag.NewFlagSet("visualize", pflag.ContinueOnError)
-	var (
-		argLayout         = argparser.String("layout", "compact", fmt.Sprintf("Layout algorithm to use; one of [%v]", layouts))
-		argVerboseCommand = argparser.Bool("verbose-command", false, "Fully display each command's text")
-	)
+	var opts Options
+	argparser.StringVar(&opts.Layout, "layout", "compact", fmt.Sprintf("Layout algorithm to use; one of [%v]", layoutNames()))
+	argparser.BoolVar(&opts.VerboseCommand, "verbose-command", false, "Fully display each command's text")
+	argparser.BoolVar(&opts.PackAdjacent, "pack-adjacent", false, "When packing recipes in to rows, prefer the row of the dependency that each recipe waited on")
+	argparser.BoolVar(&opts.TimeAxis, "time-axis", true, "Draw a time axis and gridlines")
+	argparser.BoolVar(&opts.RestartMarkers, "restart-markers", false, "Mark where the top-level make restarted")
+	argparser.StringVar(&opts.ColorBy, "color-by", "none", fmt.Sprintf("How to color commands; one of [%v]", colorSchemes))
+	argparser.StringVar(&opts.Format, "format", "svg", fmt.Sprintf("Output format; one of [%v]", formats))
+	argparser.DurationVar(&opts.Filter.MinDuration, "min-duration", 0, "Hide commands that took less time than this (with --collapse, merge runs of recipes that did in to bands first)")
+	argparser.StringArrayVar(&opts.Filter.Include, "include", nil, "Only show commands whose target or command text matches this glob (may be given multiple times)")
+	argparser.StringArrayVar(&opts.Filter.Exclude, "exclude", nil, "Hide commands whose target or command text matches this glob (may be given multiple times)")
+	argparser.IntVar(&opts.Filter.Collapse, "collapse", 0, "Merge runs of at least this many sibling recipes with the same target directory and extension in to one band")
 	err := argparser.Parse(args)
 	if err != nil {
 		return err
 	}
-	if !inArray(*argLayout, layouts) {
-		return errors.Errorf("invalid --layout: %q", *argLayout)
-	}
 	if argCnt := len(argparser.Args()); argCnt > 0 {
 		return errors.Errorf("got %d positional arguments; visualize doesn't take positional arguments", argCnt)
 	}
-
-	profileBytes, err := ioutil.ReadAll(os.Stdin)
-	if err != nil {
-		return err
-	}
-	var profileStructRaw RawProfile
-	err = json.Unmarshal(profileBytes, &profileStructRaw)
+	renderer, err := NewRenderer(opts)
 	if err != nil {
 		return err
 	}
 
-	profileStructSVG, err := convertProfile(profileStructRaw)
+	profile, err := protocol.ReadProfile(os.Stdin)
 	if err != nil {
 		return err
 	}
-
-	if err = profileStructSVG.SVG(os.Stdout, *argLayout, *argVerboseCommand); err != nil {
-		return err
-	}
-
-	return nil
+	return renderer.Render(os.Stdout, profile)
 }
@@ -10,6 +10,8 @@ type RawProfile = protocol.Profile
 
 type RawCommand = protocol.ProfiledCommand
 
+type RawSample = protocol.Sample
+
 type RawCommandList []RawCommand
 
 func (cmds RawCommandList) StartTime() time.Time {
@@ -0,0 +1,74 @@
+package visualize
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+// Options are the ways that a profile can be rendered; they correspond to the flags of `visualize`.
+type Options struct {
+	// Format is one of the formats ("svg" or "dot").
+	Format string
+	// Layout is the name of one of the layouts ("wallclock", "compact", "lanes", or "dirs").
+	Layout string
+	// VerboseCommand fully displays each command's text, instead of one line of it.
+	VerboseCommand bool
+	// PackAdjacent, when packing recipes in to rows, prefers the row of the dependency that
+	// each recipe waited on.
+	PackAdjacent bool
+	// TimeAxis draws a time axis and gridlines.
+	TimeAxis bool
+	// RestartMarkers marks where the top-level make restarted.
+	RestartMarkers bool
+	// ColorBy is one of the color schemes ("none", "dir", "tool", "status", "cpu", or
+	// "duration").
+	ColorBy string
+	// Filter leaves parts of the profile out.
+	Filter Filter
+}
+
+// A Renderer renders profiles with a fixed set of Options.  It's safe to use from several
+// goroutines at once.
+type Renderer struct {
+	opts Options
+}
+
+// NewRenderer checks the options, and returns a Renderer that uses them.
+func NewRenderer(opts Options) (*Renderer, error) {
+	if !inArray(opts.Format, formats) {
+		return nil, errors.Errorf("invalid --format: %q", opts.Format)
+	}
+	if lookupLayout(opts.Layout) == nil {
+		return nil, errors.Errorf("invalid --layout: %q", opts.Layout)
+	}
+	if !inArray(opts.ColorBy, colorSchemes) {
+		return nil, errors.Errorf("invalid --color-by: %q", opts.ColorBy)
+	}
+	if err := opts.Filter.compile(); err != nil {
+		return nil, err
+	}
+	return &Renderer{opts: opts}, nil
+}
+
+// Render writes the profile to w.  The profile isn't modified.
+func (r *Renderer) Render(w io.Writer, profile protocol.Profile) error {
+	p, err := convertProfile(profile)
+	if err != nil {
+		return err
+	}
+	if err := r.opts.Filter.Apply(p); err != nil {
+		return err
+	}
+	v := newView(p, r.opts)
+	switch r.opts.Format {
+	case "svg":
+		return p.SVG(v, w)
+	case "dot":
+		return p.DOT(v, w)
+	default:
+		panic(errors.Errorf("invalid format %q", r.opts.Format))
+	}
+}
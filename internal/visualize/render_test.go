@@ -0,0 +1,248 @@
+package visualize
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datawire/profile-make/internal/protocol"
+)
+
+// syntheticProfile returns a profile of a recursive build with numDirs sub-makes, each of which
+// ran recipesPerDir recipes of one command each, -j8 at both levels.
+func syntheticProfile(numDirs, recipesPerDir int) protocol.Profile {
+	const (
+		jobs   = 8
+		topDir = "/src"
+	)
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tools := []string{"cc -c -o %s %s.c", "go build -o %s ./%s", "ld -o %s %s.o", "protoc --go_out=%s %s.proto"}
+	existed := false
+
+	profile := protocol.Profile{
+		StartTime:   start,
+		MakeVersion: "GNU Make 4.3",
+		NumCPU:      jobs,
+	}
+	var dirStart []time.Time // when each of the top-level make's job slots is free
+	for i := 0; i < jobs; i++ {
+		dirStart = append(dirStart, start)
+	}
+	for d := 0; d < numDirs; d++ {
+		dir := filepath.Join(topDir, fmt.Sprintf("dir%d", d))
+		slot := d % jobs
+
+		var subCommands []protocol.ProfiledCommand
+		free := make([]time.Time, jobs)
+		for i := range free {
+			free[i] = dirStart[slot].Add(time.Millisecond)
+		}
+		finish := dirStart[slot]
+		for r := 0; r < recipesPerDir; r++ {
+			target := filepath.Join(dir, fmt.Sprintf("obj%d.o", r))
+			var deps []string
+			if r > 0 {
+				deps = append(deps, filepath.Join(dir, fmt.Sprintf("obj%d.o", rng.Intn(r))))
+			}
+			s := free[r%jobs]
+			f := s.Add(time.Duration(1+rng.Intn(20)) * time.Millisecond)
+			free[r%jobs] = f
+			if f.After(finish) {
+				finish = f
+			}
+			exitCode := 0
+			if rng.Intn(100) == 0 {
+				exitCode = 1
+			}
+			subCommands = append(subCommands, protocol.ProfiledCommand{
+				StartTime:           s,
+				FinishTime:          f,
+				MakeLevel:           1,
+				MakeDir:             dir,
+				RecipeTarget:        target,
+				RecipeDependencies:  deps,
+				RecipeTargetExisted: &existed,
+				Args:                []string{"/bin/sh", "-c", fmt.Sprintf(tools[r%len(tools)], target, target)},
+				ExitCode:            exitCode,
+				UserTime:            time.Duration(rng.Int63n(int64(f.Sub(s)))),
+				SystemTime:          time.Duration(rng.Int63n(int64(f.Sub(s)) / 4)),
+			})
+		}
+		finish = finish.Add(time.Millisecond)
+		profile.Commands = append(profile.Commands, protocol.ProfiledCommand{
+			StartTime:           dirStart[slot],
+			FinishTime:          finish,
+			MakeDir:             topDir,
+			RecipeTarget:        filepath.Join(topDir, fmt.Sprintf("dir%d", d)),
+			RecipeTargetExisted: &existed,
+			Args:                []string{"/bin/sh", "-c", fmt.Sprintf("make -C dir%d", d)},
+			SubCommands:         subCommands,
+		})
+		dirStart[slot] = finish
+	}
+	for _, t := range dirStart {
+		if t.After(profile.FinishTime) {
+			profile.FinishTime = t
+		}
+	}
+	return profile
+}
+
+// fixedProfile returns a small profile with a bit of everything in it: sub-makes, a restart,
+// shims, a timed-out and an unfinished command, samples, and text that needs escaping.
+func fixedProfile() protocol.Profile {
+	profile := syntheticProfile(3, 24)
+	at := func(ms int) time.Time { return profile.StartTime.Add(time.Duration(ms) * time.Millisecond) }
+	existed := true
+
+	sub := &profile.Commands[0].SubCommands[5]
+	sub.Args = []string{"/bin/sh", "-c", "# compile it\ncc -c -o 'a <&> b.o' \"$<\" && echo done >&2"}
+	sub.RecipeTarget = "/src/dir0/a <&> b.o"
+	sub.SubCommands = []protocol.ProfiledCommand{{
+		StartTime:  sub.StartTime.Add(time.Millisecond / 2),
+		FinishTime: sub.FinishTime,
+		MakeLevel:  1,
+		MakeDir:    "/src/dir0",
+		Shim:       true,
+		Args:       []string{"cc", "-c", "-o", "a <&> b.o", "a.c"},
+	}}
+	timedOut := &profile.Commands[1].SubCommands[3]
+	timedOut.TimedOut = true
+	timedOut.ExitCode = -1
+
+	var subMakes []protocol.ProfiledCommand
+	for i, dir := range []string{"/src/x", "/src/y", "/src/z"} {
+		subMakes = append(subMakes, protocol.ProfiledCommand{
+			StartTime:    at(10 + 10*i),
+			FinishTime:   at(15 + 10*i),
+			MakeLevel:    1,
+			MakeDir:      dir,
+			RecipeTarget: dir + "/gen.go",
+			Args:         []string{"/bin/sh", "-c", "go generate"},
+		})
+	}
+	profile.Commands = append(profile.Commands, protocol.ProfiledCommand{
+		StartTime:    at(5),
+		FinishTime:   at(50),
+		MakeDir:      "/src",
+		RecipeTarget: "/src/generate",
+		Args:         []string{"/bin/sh", "-c", "for d in x y z; do $(MAKE) -C $d; done"},
+		SubCommands:  subMakes,
+	})
+
+	finish := profile.FinishTime
+	profile.Commands = append(profile.Commands,
+		protocol.ProfiledCommand{
+			StartTime:           finish,
+			FinishTime:          finish.Add(5 * time.Millisecond),
+			MakeDir:             "/src",
+			MakeRestarts:        1,
+			RecipeTarget:        "/src/all",
+			RecipeDependencies:  []string{"/src/dir0", "/src/dir1", "/src/dir2"},
+			RecipeTargetExisted: &existed,
+			Args:                []string{"/bin/sh", "-c", "if true; then\n\tsleep 1\nfi"},
+		},
+		protocol.ProfiledCommand{
+			StartTime:    finish.Add(5 * time.Millisecond),
+			FinishTime:   finish.Add(10 * time.Millisecond),
+			MakeDir:      "/src",
+			MakeRestarts: 1,
+			RecipeTarget: "/src/check",
+			Args:         []string{"/bin/sh", "-c", "go test ./..."},
+			ExitCode:     -1,
+			Unfinished:   true,
+		})
+	profile.FinishTime = finish.Add(10 * time.Millisecond)
+	profile.Interrupted = true
+	for ms := 0; at(ms).Before(profile.FinishTime); ms += 50 {
+		profile.Samples = append(profile.Samples, protocol.Sample{
+			Time:         at(ms),
+			LoadAvg:      float64(ms%7) / 2,
+			CPUBusy:      float64(ms%10) / 10,
+			MemTotal:     1 << 30,
+			MemAvailable: 1<<29 + uint64(ms)<<10,
+			DiskRead:     uint64(ms) << 8,
+		})
+	}
+	return profile
+}
+
+func TestRender(t *testing.T) {
+	profile := fixedProfile()
+	render := func(opts Options) []byte {
+		renderer, err := NewRenderer(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := renderer.Render(&out, profile); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		return out.Bytes()
+	}
+	for _, format := range formats {
+		for _, layout := range layoutNames() {
+			for _, colorBy := range colorSchemes {
+				for _, opts := range []Options{
+					{Format: format, Layout: layout, ColorBy: colorBy},
+					{Format: format, Layout: layout, ColorBy: colorBy,
+						VerboseCommand: true,
+						PackAdjacent:   true,
+						TimeAxis:       true,
+						RestartMarkers: true,
+						Filter:         Filter{Collapse: 3, MinDuration: 5 * time.Millisecond},
+					},
+				} {
+					out := render(opts)
+					if again := render(opts); !bytes.Equal(out, again) {
+						t.Errorf("%+v: rendering the same profile twice gave different output", opts)
+					}
+					if format != "svg" {
+						continue
+					}
+					dec := xml.NewDecoder(bytes.NewReader(out))
+					for {
+						if _, err := dec.Token(); err != nil {
+							if err != io.EOF {
+								t.Errorf("%+v: invalid XML: %v", opts, err)
+							}
+							break
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	profile := syntheticProfile(50, 2000)
+	for _, layout := range layoutNames() {
+		for _, colorBy := range colorSchemes {
+			b.Run(layout+"/"+colorBy, func(b *testing.B) {
+				renderer, err := NewRenderer(Options{
+					Format:   "svg",
+					Layout:   layout,
+					TimeAxis: true,
+					ColorBy:  colorBy,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := renderer.Render(ioutil.Discard, profile); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
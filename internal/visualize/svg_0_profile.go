@@ -1,133 +1,219 @@
 package visualize
 
 import (
-	"html/template"
+	"fmt"
 	"io"
 	"time"
-
-	"github.com/pkg/errors"
 )
 
 type SVGProfile struct {
 	StartTime  time.Time
 	FinishTime time.Time
-	Make       *SVGMake
+	// Interrupted is whether the build was interrupted, so that the profile is partial.
+	Interrupted bool
+	// NumCPU is how many CPUs the build could use, or 0 if that's unknown.
+	NumCPU  int
+	Samples []RawSample
+	Make    *SVGMake
 }
 
 func (p *SVGProfile) Duration() time.Duration {
 	return p.FinishTime.Sub(p.StartTime)
 }
 
-func (p *SVGProfile) W() XDuration {
-	switch globalLayout {
-	case "wallclock":
-		return XDuration(p.Duration())
-	case "compact":
-		return p.Make.W()
-	default:
-		panic(errors.Errorf("invalid layout %q", globalLayout))
-	}
+func (p *SVGProfile) W(v *view) XDuration {
+	return v.Timeline().W
+}
+
+func (p *SVGProfile) H(v *view) YLines {
+	return p.AxisH(v) + v.Timeline().H + p.SampleTracksH(v) + p.LegendH(v)
 }
 
-func (p *SVGProfile) H() YLines {
-	return p.Make.H()
+// svgHeader is the <defs> and <style> at the top of every profile; it is a format string, with one
+// verb, for the overflow of the boxes.
+const svgHeader = `<defs>
+	<filter id="inset-shadow-black">
+		<!-- We implicitly start with an opaque black rectangle -->
+		<!-- Set the alpha-chanel to an inverted copy of the source alpha-channel -->
+		<feComponentTransfer in="SourceAlpha">
+			<feFuncA type="table" tableValues="1 0" />
+		</feComponentTransfer>
+		<!-- Blur it; bleed the shadow in to the image -->
+		<feGaussianBlur stdDeviation="4" />
+		<!-- Clip to the source image; only leave what blead in to the image -->
+		<feComposite in2="SourceAlpha" operator="in" />
+		<!-- Dye it black -->
+		<feOffset dx="0" dy="0" result="shape"/>
+		<feFlood flood-color="#000000" result="color"/>
+		<feComposite in="color" in2="shape" operator="in" />
+		<!-- Overlay the shadow on top of the source image -->
+		<feMerge>
+			<feMergeNode in="SourceGraphic" />
+			<feMergeNode />
+		</feMerge>
+	</filter>
+	<filter id="inset-shadow-red">
+		<!-- We implicitly start with an opaque black rectangle -->
+		<!-- Set the alpha-chanel to an inverted copy of the source alpha-channel -->
+		<feComponentTransfer in="SourceAlpha">
+			<feFuncA type="table" tableValues="1 0" />
+		</feComponentTransfer>
+		<!-- Blur it; bleed the shadow in to the image -->
+		<feGaussianBlur stdDeviation="4" />
+		<!-- Clip to the source image; only leave what blead in to the image -->
+		<feComposite in2="SourceAlpha" operator="in" />
+		<!-- Dye it red -->
+		<feOffset dx="0" dy="0" result="shape"/>
+		<feFlood flood-color="#FF0000" result="color"/>
+		<feComposite in="color" in2="shape" operator="in" />
+		<!-- Overlay the shadow on top of the source image -->
+		<feMerge>
+			<feMergeNode in="SourceGraphic" />
+			<feMergeNode />
+		</feMerge>
+	</filter>
+	<filter id="inset-shadow-green">
+		<!-- We implicitly start with an opaque black rectangle -->
+		<!-- Set the alpha-chanel to an inverted copy of the source alpha-channel -->
+		<feComponentTransfer in="SourceAlpha">
+			<feFuncA type="table" tableValues="1 0" />
+		</feComponentTransfer>
+		<!-- Blur it; bleed the shadow in to the image -->
+		<feGaussianBlur stdDeviation="1" />
+		<!-- Clip to the source image; only leave what blead in to the image -->
+		<feComposite in2="SourceAlpha" operator="in" />
+		<!-- Dye it red -->
+		<feOffset dx="0" dy="0" result="shape"/>
+		<feFlood flood-color="#AAFFAA" result="color"/>
+		<feComposite in="color" in2="shape" operator="in" />
+		<!-- Overlay the shadow on top of the source image -->
+		<feMerge>
+			<feMergeNode in="SourceGraphic" />
+			<feMergeNode />
+		</feMerge>
+	</filter>
+</defs>
+<style>
+	* svg {
+		overflow: %s;
+	}
+	svg.make                  { filter: url(#inset-shadow-black); }
+	svg.make > .background    { fill: #CCCCCC;	}
+
+	svg.restart               { filter: url(#inset-shadow-red); }
+	svg.restart > .background { fill: #999999; }
+
+	svg.recipe                { filter: url(#inset-shadow-black); }
+	svg.recipe > .background  { fill: #666666; }
+
+	svg.lane                  { filter: url(#inset-shadow-black); }
+	svg.lane > .background    { fill: #CCCCCC; }
+	svg.band                  { filter: url(#inset-shadow-black); }
+	svg.band > .background    { fill: #CCCCCC; }
+	svg.band > text.label     { font-weight: bold; }
+
+	svg.command               { }
+	svg.command > .background { fill: #333333; filter: url(#inset-shadow-green); }
+	svg.command > text        { fill: #FFFFFF; }
+	tspan.sh-program          { fill: #FFD75F; font-weight: bold; }
+	tspan.sh-assignment       { fill: #AFD787; }
+	tspan.sh-redirect         { fill: #D7AFFF; }
+	tspan.sh-operator         { fill: #87D7FF; font-weight: bold; }
+	tspan.sh-keyword          { fill: #FF875F; font-weight: bold; }
+	tspan.sh-string           { fill: #D7D7AF; }
+	tspan.sh-expansion        { fill: #5FD7D7; }
+	tspan.sh-comment          { fill: #AAAAAA; font-style: italic; }
+
+	svg.axis > text           { font-size: 80%%; }
+	svg.axis > .caption       { fill: #666666; }
+	svg.axis > line           { stroke: #000000; }
+	line.gridline             { stroke: #FFFFFF; stroke-opacity: 0.3; pointer-events: none; }
+	line.restart-marker       { stroke: #FF0000; stroke-dasharray: 4 2; pointer-events: none; }
+	text.restart-marker       { fill: #FF0000; font-size: 80%%; pointer-events: none; }
+
+	svg.track > .background   { fill: #EEEEEE; }
+	svg.track polygon         { fill: #1F77B4; fill-opacity: 0.5; stroke: #1F77B4; vector-effect: non-scaling-stroke; }
+	svg.track line.limit      { stroke: #D62728; stroke-dasharray: 4 2; vector-effect: non-scaling-stroke; }
+	svg.track > text          { font-size: 80%%; }
+
+	svg.legend text           { font-size: 80%%; }
+</style>
+`
+
+// SVG writes the profile as an SVG.
+func (p *SVGProfile) SVG(v *view, w io.Writer) error {
+	out := newSVGWriter(w)
+	p.WriteSVG(v, out)
+	return out.Flush()
 }
 
-var profileTemplate = template.Must(template.
-	New("<x-profile>").
-	Funcs(funcMap).
-	Parse(`<svg xmlns="http://www.w3.org/2000/svg"
-		  width="100%"
-		  height="{{ .Data.H.EM }}" >
-		<defs>
-			<filter id="inset-shadow-black">
-				<!-- We implicitly start with an opaque black rectangle -->
-				<!-- Set the alpha-chanel to an inverted copy of the source alpha-channel -->
-				<feComponentTransfer in="SourceAlpha">
-					<feFuncA type="table" tableValues="1 0" />
-				</feComponentTransfer>
-				<!-- Blur it; bleed the shadow in to the image -->
-				<feGaussianBlur stdDeviation="4" />
-				<!-- Clip to the source image; only leave what blead in to the image -->
-				<feComposite in2="SourceAlpha" operator="in" />
-				<!-- Dye it black -->
-				<feOffset dx="0" dy="0" result="shape"/>
-				<feFlood flood-color="#000000" result="color"/>
-				<feComposite in="color" in2="shape" operator="in" />
-				<!-- Overlay the shadow on top of the source image -->
-				<feMerge>
-					<feMergeNode in="SourceGraphic" />
-					<feMergeNode />
-				</feMerge>
-			</filter>
-			<filter id="inset-shadow-red">
-				<!-- We implicitly start with an opaque black rectangle -->
-				<!-- Set the alpha-chanel to an inverted copy of the source alpha-channel -->
-				<feComponentTransfer in="SourceAlpha">
-					<feFuncA type="table" tableValues="1 0" />
-				</feComponentTransfer>
-				<!-- Blur it; bleed the shadow in to the image -->
-				<feGaussianBlur stdDeviation="4" />
-				<!-- Clip to the source image; only leave what blead in to the image -->
-				<feComposite in2="SourceAlpha" operator="in" />
-				<!-- Dye it red -->
-				<feOffset dx="0" dy="0" result="shape"/>
-				<feFlood flood-color="#FF0000" result="color"/>
-				<feComposite in="color" in2="shape" operator="in" />
-				<!-- Overlay the shadow on top of the source image -->
-				<feMerge>
-					<feMergeNode in="SourceGraphic" />
-					<feMergeNode />
-				</feMerge>
-			</filter>
-			<filter id="inset-shadow-green">
-				<!-- We implicitly start with an opaque black rectangle -->
-				<!-- Set the alpha-chanel to an inverted copy of the source alpha-channel -->
-				<feComponentTransfer in="SourceAlpha">
-					<feFuncA type="table" tableValues="1 0" />
-				</feComponentTransfer>
-				<!-- Blur it; bleed the shadow in to the image -->
-				<feGaussianBlur stdDeviation="1" />
-				<!-- Clip to the source image; only leave what blead in to the image -->
-				<feComposite in2="SourceAlpha" operator="in" />
-				<!-- Dye it red -->
-				<feOffset dx="0" dy="0" result="shape"/>
-				<feFlood flood-color="#AAFFAA" result="color"/>
-				<feComposite in="color" in2="shape" operator="in" />
-				<!-- Overlay the shadow on top of the source image -->
-				<feMerge>
-					<feMergeNode in="SourceGraphic" />
-					<feMergeNode />
-				</feMerge>
-			</filter>
-		</defs>
-		<style>
-			* svg {
-				overflow: {{ if verboseCommand }}visible{{ else }}hidden{{ end }};
+// WriteSVG writes the whole profile, in one pass.
+func (p *SVGProfile) WriteSVG(v *view, w *svgWriter) {
+	w.printf(`<svg xmlns="http://www.w3.org/2000/svg" width="100%%" height="%s">`+"\n", p.H(v).EM())
+	overflow := "hidden"
+	if v.VerboseCommand {
+		overflow = "visible"
+	}
+	w.printf(svgHeader, overflow)
+	w.printf("<g>\n")
+
+	W := p.W(v)
+	ticks := p.Ticks(v)
+	if axisH := p.AxisH(v); axisH > 0 {
+		w.printf(`<svg class="axis" x="0" y="0" width="100%%" height="%s">`+"\n", axisH.EM())
+		w.printf(`<title xml:space="preserve">%s</title>`+"\n", esc(p.AxisCaption(v)))
+		w.printf(`<text class="caption" x="100%%" y="%s" dx="-2" dominant-baseline="hanging" text-anchor="end">%s</text>`+"\n",
+			YLines(1).EM(), esc(p.AxisCaption(v)))
+		w.printf(`<line x1="0" y1="100%%" x2="100%%" y2="100%%" />` + "\n")
+		for _, tick := range ticks {
+			w.printf(`<text x="%s" y="0" dx="2" dominant-baseline="hanging">%s</text>`+"\n",
+				tick.X.PercentOf(W), esc(tick.Label))
+			w.printf(`<line x1="%s" y1="%s" x2="%s" y2="100%%" />`+"\n",
+				tick.X.PercentOf(W), YLines(1).EM(), tick.X.PercentOf(W))
+		}
+		w.printf("</svg>\n")
+	}
+
+	timeline := v.Timeline()
+	w.printf(`<svg class="timeline" x="0" y="%s" width="100%%" height="%s">`+"\n", p.AxisH(v).EM(), timeline.H.EM())
+	timeline.writeChildren(v, w)
+	w.printf("</svg>\n")
+	p.writeSampleTracks(v, w, p.SampleTracks(v), p.AxisH(v)+timeline.H)
+
+	if axisH := p.AxisH(v); axisH > 0 {
+		for _, tick := range ticks {
+			w.printf(`<line class="gridline" x1="%s" y1="%s" x2="%s" y2="100%%" />`+"\n",
+				tick.X.PercentOf(W), axisH.EM(), tick.X.PercentOf(W))
+		}
+	}
+	for _, marker := range p.RestartMarkers(v) {
+		w.printf(`<line class="restart-marker" x1="%s" y1="%s" x2="%s" y2="100%%" />`+"\n",
+			marker.X.PercentOf(W), p.AxisH(v).EM(), marker.X.PercentOf(W))
+		w.printf(`<text class="restart-marker" x="%s" y="%s" dx="2" dominant-baseline="hanging">%s</text>`+"\n",
+			marker.X.PercentOf(W), p.AxisH(v).EM(), esc(marker.Label))
+	}
+	if legend := p.Legend(v); len(legend) > 0 {
+		w.printf(`<svg class="legend" x="0" y="%s" width="100%%" height="%s">`+"\n",
+			(p.AxisH(v) + timeline.H + p.SampleTracksH(v)).EM(), p.LegendH(v).EM())
+		for row, entries := range legend {
+			for col, entry := range entries {
+				w.printf(`<svg x="%s" y="%s" width="%s" height="%s">`+"\n",
+					legendX(col), YLines(row).EM(), legendX(1), YLines(1).EM())
+				if entry.Color != "" {
+					w.printf(`<rect x="0" y="15%%" width="1em" height="70%%" fill="%s" />`+"\n", esc(entry.Color))
+				}
+				w.printf(`<text x="1.5em" y="50%%" dominant-baseline="middle">%s</text>`+"\n", esc(entry.Label))
+				w.printf("</svg>\n")
 			}
-			svg.make                  { filter: url(#inset-shadow-black); }
-			svg.make > .background    { fill: #CCCCCC;	}
-
-			svg.restart               { filter: url(#inset-shadow-red); }
-			svg.restart > .background { fill: #999999; }
-
-			svg.recipe                { filter: url(#inset-shadow-black); }
-			svg.recipe > .background  { fill: #666666; }
-
-			svg.command               { }
-			svg.command > .background { fill: #333333; filter: url(#inset-shadow-green); }
-			svg.command > text        { fill: #FFFFFF; }
-		</style>
-		<g>
-			{{ .Data.Make.SVG (asXDuration 0) (asYLines 0) }}
-		</g>
-	</svg>`))
-
-func (p *SVGProfile) SVG(w io.Writer, layout string, verboseCommand bool) error {
-	globalProfile = p
-	globalLayout = layout
-	globalVerboseCommand = verboseCommand
-	return profileTemplate.Execute(w, map[string]interface{}{
-		"Data": p,
-	})
+		}
+		w.printf("</svg>\n")
+	}
+
+	w.printf("</g>\n")
+	w.printf("</svg>\n")
+}
+
+// legendX is the X position of a column of the legend.
+func legendX(col int) string {
+	return fmt.Sprintf("%f%%", 100*float64(col)/legendColumns)
 }
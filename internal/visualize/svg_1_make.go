@@ -2,40 +2,34 @@ package visualize
 
 import (
 	"fmt"
-	"html/template"
-	"path/filepath"
-	"strings"
 	"time"
-
-	"github.com/pkg/errors"
 )
 
+// shimsKey is the SubMakes key for the programs that a command ran through `run --shim`
+// wrappers; it sorts after the CURDIRs, so they get drawn below any real sub-makes.
+const shimsKey = "~shims"
+
 type SVGMake struct {
-	Parent   *SVGCommand
-	Dir      string
+	Parent *SVGCommand
+	Dir    string
+	// Shims is whether this isn't really a make, but the programs that the parent command ran
+	// through `run --shim` wrappers, as a single "" recipe.
+	Shims    bool
 	Restarts []*SVGRestart
 }
 
-func (m *SVGMake) Title() string {
-	dir, err := filepath.Rel(globalProfile.Make.Dir, m.Dir)
-	if err != nil {
-		dir = m.Dir
+func (m *SVGMake) Title(v *view) string {
+	dir := v.rel(m.Dir)
+	if m.Shims {
+		return fmt.Sprintf("Shimmed programs\n"+
+			"Dir: %q",
+			dir)
 	}
 	return fmt.Sprintf("Make\n"+
 		"Dir: %q",
 		dir)
 }
 
-func (m *SVGMake) ParentW() XDuration {
-	if m == nil {
-		return 0
-	}
-	if m.Parent == nil {
-		return m.W()
-	}
-	return m.Parent.W()
-}
-
 ////////////////////////////////////////////////////////////////////////////////
 
 func (m *SVGMake) StartTime() time.Time {
@@ -52,87 +46,8 @@ func (m *SVGMake) FinishTime() time.Time {
 	return m.Restarts[len(m.Restarts)-1].FinishTime()
 }
 
-func (m *SVGMake) W() XDuration {
-	if m == nil {
-		return 0
-	}
-	switch globalLayout {
-	case "wallclock":
-		return XDuration(m.FinishTime().Sub(m.StartTime()))
-	case "compact":
-		var sum XDuration
-		for _, restart := range m.Restarts {
-			sum += restart.W()
-		}
-		return sum
-	default:
-		panic(errors.Errorf("invalid layout %q", globalLayout))
-	}
-}
-
-func (m *SVGMake) H() YLines {
-	if m == nil {
-		return 0
-	}
-	var max YLines
-	for _, restart := range m.Restarts {
-		if restartH := restart.H(); restartH > max {
-			max = restartH
-		}
-	}
-	return max
-}
-
-var makeTemplateWallclock = template.Must(template.
-	New("<x-make>").
-	Funcs(funcMap).
-	Parse(`<svg class="make"
-		    x="{{ .Attrs.X.PercentOf .Data.ParentW }}" y="{{ .Attrs.Y.EM }}"
-		    width="{{ .Data.W.PercentOf .Data.ParentW }}" height="{{ .Data.H.EM }}">
-		<title xml:space="preserve">{{ .Data.Title }}</title>
-		<rect class="background" x="0" y="0" width="100%" height="100%" />
-		{{ range .Data.Restarts }}
-			{{ $xoff := (.StartTime.Sub $.Data.StartTime) | asXDuration }}
-			{{ .SVG $xoff 0 }}
-		{{ end }}
-	</svg>`))
-
-var makeTemplateCompact = template.Must(template.
-	New("<x-make>").
-	Funcs(funcMap).
-	Parse(`<svg class="make"
-		    x="{{ .Attrs.X.PercentOf .Data.ParentW }}" y="{{ .Attrs.Y.EM }}"
-		    width="{{ .Data.W.PercentOf .Data.ParentW }}" height="{{ .Data.H.EM }}">
-		<title xml:space="preserve">{{ .Data.Title }}</title>
-		<rect class="background" x="0" y="0" width="100%" height="100%" />
-		{{ $xoff := asXDuration 0 }}
-		{{ range .Data.Restarts }}
-			{{ .SVG $xoff 0 }}
-			{{ $xoff = $xoff.Add .W }}
-		{{ end }}
-	</svg>`))
-
-func (m *SVGMake) SVG(X XDuration, Y YLines) (template.HTML, error) {
-	var makeTemplate *template.Template
-	switch globalLayout {
-	case "wallclock":
-		makeTemplate = makeTemplateWallclock
-	case "compact":
-		makeTemplate = makeTemplateCompact
-	default:
-		panic(errors.Errorf("invalid layout %q", globalLayout))
-	}
-
-	var str strings.Builder
-	err := makeTemplate.Execute(&str, map[string]interface{}{
-		"Attrs": map[string]interface{}{
-			"X": X,
-			"Y": Y,
-		},
-		"Data": m,
-	})
-	if err != nil {
-		return "", err
-	}
-	return template.HTML(str.String()), nil
+func (m *SVGMake) WriteSVG(v *view, w *svgWriter, box *Box, parentW XDuration) {
+	w.openBox("make", box, parentW, m.Title(v), "")
+	box.writeChildren(v, w)
+	w.closeBox()
 }
@@ -2,10 +2,7 @@ package visualize
 
 import (
 	"fmt"
-	"html/template"
-	"path/filepath"
 	"sort"
-	"strings"
 	"time"
 )
 
@@ -15,16 +12,44 @@ type SVGRecipe struct {
 	Commands []*SVGCommand
 }
 
-func (recipe *SVGRecipe) Title() string {
-	target, err := filepath.Rel(globalProfile.Make.Dir, recipe.Name)
-	if err != nil {
-		target = recipe.Name
-	}
-	return fmt.Sprintf("Make/Restart/Recipe\n"+
+func (recipe *SVGRecipe) Title(v *view) string {
+	target := v.rel(recipe.Name)
+	title := fmt.Sprintf("Make/Restart/Recipe\n"+
 		"Target: %q\n"+
 		"Duration: %s",
 		target,
-		recipe.FinishTime().Sub(recipe.StartTime()))
+		v.finishTime(recipe).Sub(v.startTime(recipe)))
+	if source := recipe.Source(v); source != "" {
+		title += "\nRule: " + source
+	}
+	if why := recipe.Why(v); why != "" {
+		title += "\nWhy: " + why
+	}
+	return title
+}
+
+// Source returns the "FILE:LINE" of the rule that the recipe came from, or "" if the profile
+// doesn't say.
+func (recipe *SVGRecipe) Source(v *view) string {
+	if recipe == nil {
+		return ""
+	}
+	for _, cmd := range recipe.Commands {
+		if cmd.Raw.RecipeSource != "" {
+			return v.rel(cmd.Raw.RecipeSource)
+		}
+	}
+	return ""
+}
+
+// Why describes why make ran the recipe.
+func (recipe *SVGRecipe) Why(v *view) string {
+	if recipe == nil || len(recipe.Commands) == 0 {
+		return ""
+	}
+	// Later commands in the recipe may see the target that earlier commands created, so ask
+	// the first one.
+	return recipe.SortedCommands()[0].Raw.Why(v.rel)
 }
 
 func (recipe *SVGRecipe) SortedCommands() []*SVGCommand {
@@ -37,9 +62,19 @@ func (recipe *SVGRecipe) SortedCommands() []*SVGCommand {
 }
 
 func (recipe *SVGRecipe) Dependencies() []string {
+	return recipe.dependencies(func(cmd *SVGCommand) []string { return cmd.Raw.RecipeDependencies })
+}
+
+// OrderOnlyDependencies returns the recipe's order-only prerequisites ($|): ones that have to be
+// made before the recipe runs, but that being newer than the target doesn't cause it to run.
+func (recipe *SVGRecipe) OrderOnlyDependencies() []string {
+	return recipe.dependencies(func(cmd *SVGCommand) []string { return cmd.Raw.RecipeOrderOnlyDependencies })
+}
+
+func (recipe *SVGRecipe) dependencies(fn func(*SVGCommand) []string) []string {
 	set := make(map[string]struct{})
 	for _, cmd := range recipe.Commands {
-		for _, dep := range cmd.Raw.RecipeDependencies {
+		for _, dep := range fn(cmd) {
 			set[dep] = struct{}{}
 		}
 	}
@@ -47,6 +82,7 @@ func (recipe *SVGRecipe) Dependencies() []string {
 	for dep := range set {
 		ret = append(ret, dep)
 	}
+	sort.Strings(ret)
 	return ret
 }
 
@@ -78,94 +114,8 @@ func (recipe *SVGRecipe) FinishTime() time.Time {
 	return max
 }
 
-func (recipe *SVGRecipe) W() XDuration {
-	if recipe == nil {
-		return 0
-	}
-	var max XDuration
-	for _, cmd := range recipe.Commands {
-		if w := cmd.W(); w > max {
-			max = w
-		}
-	}
-	return max
-}
-
-func (recipe *SVGRecipe) H() YLines {
-	if recipe == nil {
-		return 0
-	}
-	if globalVerboseCommand {
-		var sum YLines
-		for _, cmd := range recipe.Commands {
-			sum += cmd.H()
-		}
-		return sum
-	} else {
-		var xCursor time.Time
-		var yCursor YLines
-		var yPending YLines
-		for _, cmd := range recipe.SortedCommands() {
-			if cmd.StartTime().After(xCursor) {
-				// happy path
-				if h := cmd.H(); h > yPending {
-					yPending = h
-				}
-			} else {
-				// sad path
-				yCursor += yPending
-				yPending = cmd.H()
-			}
-		}
-		return yCursor + yPending
-	}
-}
-
-var recipeTemplate = template.Must(template.
-	New("<x-recipe>").
-	Funcs(funcMap).
-	Parse(`<svg class="recipe"
-		    x="{{ .Attrs.X.PercentOf .Data.Parent.W }}" y="{{ .Attrs.Y.EM }}"
-		    width="{{ .Data.W.PercentOf .Data.Parent.W }}" height="{{ .Data.H.EM }}">
-		<title xml:space="preserve">{{ .Data.Title }}</title>
-		<rect class="background" x="0" y="0" width="100%" height="100%" />
-		{{ if verboseCommand }}
-			{{ $yoff := asYLines 0 }}
-			{{ range .Data.SortedCommands }}
-				{{ $xoff := (.StartTime.Sub $.Data.StartTime) | asXDuration }}
-				{{ .SVG $xoff $yoff }}
-				{{ $yoff = $yoff.Add .H }}
-			{{ end }}
-		{{ else }}
-			{{ $xCursor := asXDuration 0 }}
-			{{ $yCursor := asYLines 0 }}
-			{{ $yPending := asYLines 0 }}
-			{{ range .Data.SortedCommands }}
-				{{ $xoff := (.StartTime.Sub $.Data.StartTime) | asXDuration }}
-				{{ if gt $xoff $xCursor }}
-					{{ if gt .H $yPending }}
-						{{ $yPending = .H }}
-					{{ end }}
-				{{ else }}
-					{{ $yCursor = $yCursor.Add $yPending }}
-					{{ $yPending = .H }}
-				{{ end }}
-				{{ .SVG $xoff $yCursor }}
-			{{ end }}
-		{{ end }}
-	</svg>`))
-
-func (recipe *SVGRecipe) SVG(X XDuration, Y YLines) (template.HTML, error) {
-	var str strings.Builder
-	err := recipeTemplate.Execute(&str, map[string]interface{}{
-		"Attrs": map[string]interface{}{
-			"X": X,
-			"Y": Y,
-		},
-		"Data": recipe,
-	})
-	if err != nil {
-		return "", err
-	}
-	return template.HTML(str.String()), nil
+func (recipe *SVGRecipe) WriteSVG(v *view, w *svgWriter, box *Box, parentW XDuration) {
+	w.openBox("recipe", box, parentW, recipe.Title(v), "")
+	box.writeChildren(v, w)
+	w.closeBox()
 }
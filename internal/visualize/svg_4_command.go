@@ -2,49 +2,86 @@ package visualize
 
 import (
 	"fmt"
-	"html/template"
-	"path/filepath"
-	"strings"
+	"sort"
 	"time"
 
-	"github.com/alessio/shellescape"
-	"github.com/pkg/errors"
+	"github.com/datawire/profile-make/internal/shellparse"
 )
 
 type SVGCommand struct {
-	Parent   *SVGRecipe
-	Raw      RawCommand
-	SubMakes map[string]*SVGMake // key is CURDIR
+	Parent    *SVGRecipe
+	Raw       RawCommand
+	SubMakes  map[string]*SVGMake // key is CURDIR, or shimsKey
+	Collapsed []*SVGRecipe        // non-nil if this is a band of collapsed recipes; see Filter
+
+	script *shellparse.Script
+}
+
+func (cmd *SVGCommand) Script() *shellparse.Script {
+	if cmd.script == nil {
+		cmd.script = shellparse.ParseArgs(cmd.Raw.Args)
+	}
+	return cmd.script
 }
 
-func (cmd *SVGCommand) Text() string {
+// Text returns the full text of the command; for the usual "/bin/sh -c SCRIPT" that's just the
+// SCRIPT.
+func (cmd *SVGCommand) Text(v *view) string {
 	if cmd == nil {
 		return ""
 	}
-	args := make([]string, len(cmd.Raw.Args))
-	for i := range cmd.Raw.Args {
-		args[i] = shellescape.Quote(cmd.Raw.Args[i])
+	if len(cmd.Collapsed) > 0 {
+		return cmd.CollapsedText(v)
+	}
+	return cmd.Script().Source
+}
+
+// Label returns the command on a single line.
+func (cmd *SVGCommand) Label(v *view) string {
+	if len(cmd.Collapsed) > 0 {
+		return cmd.CollapsedText(v)
 	}
-	return strings.Join(args, " ")
+	return cmd.Script().Label()
 }
 
-func (cmd *SVGCommand) Title() string {
-	target, err := filepath.Rel(globalProfile.Make.Dir, cmd.Raw.RecipeTarget)
-	if err != nil {
-		target = cmd.Raw.RecipeTarget
+// Lines returns the syntax-highlighted lines of the command, for --verbose-command.
+func (cmd *SVGCommand) Lines(v *view) [][]shellparse.Span {
+	if len(cmd.Collapsed) > 0 {
+		return [][]shellparse.Span{{{Text: cmd.CollapsedText(v)}}}
 	}
-	return fmt.Sprintf("Make/Restart/Recipe/Command\n"+
+	return cmd.Script().Highlight()
+}
+
+func (cmd *SVGCommand) Title(v *view) string {
+	target := v.rel(cmd.Raw.RecipeTarget)
+	shell := cmd.Script().Shell
+	if shell == "" {
+		shell = "(none)"
+	}
+	duration := cmd.FinishTime().Sub(cmd.StartTime()).String()
+	if cmd.Unfinished() {
+		duration += " (still running when the build was interrupted)"
+	}
+	title := fmt.Sprintf("Make/Restart/Recipe/Command\n"+
 		"Target: %q\n"+
-		"Duration: %s\n"+
-		"Command: \n%s",
+		"Duration: %s\n",
 		target,
-		cmd.FinishTime().Sub(cmd.StartTime()),
-		cmd.Text())
+		duration)
+	if source := cmd.Parent.Source(v); source != "" {
+		title += "Rule: " + source + "\n"
+	}
+	if why := cmd.Parent.Why(v); why != "" {
+		title += "Why: " + why + "\n"
+	}
+	return title + fmt.Sprintf("Shell: %s\n"+
+		"Command: \n%s",
+		shell,
+		cmd.Text(v))
 }
 
-func (cmd *SVGCommand) BaseH() YLines {
-	if globalVerboseCommand {
-		return YLines(strings.Count(cmd.Text(), "\n") + 1)
+func (cmd *SVGCommand) BaseH(v *view) YLines {
+	if v.VerboseCommand {
+		return YLines(len(cmd.Lines(v)))
 	} else {
 		return 1
 	}
@@ -66,74 +103,41 @@ func (cmd *SVGCommand) FinishTime() time.Time {
 	return cmd.Raw.FinishTime
 }
 
-func (cmd *SVGCommand) W() XDuration {
-	if cmd == nil {
-		return 0
-	}
-	switch globalLayout {
-	case "wallclock":
-		return XDuration(cmd.FinishTime().Sub(cmd.StartTime()))
-	case "compact":
-		switch len(cmd.SubMakes) {
-		case 1:
-			var sub *SVGMake
-			for _, m := range cmd.SubMakes {
-				sub = m
-			}
-			cmdWall := XDuration(cmd.FinishTime().Sub(cmd.StartTime()))
-			subWall := XDuration(sub.FinishTime().Sub(sub.StartTime()))
-			subCompact := sub.W()
-			return subCompact + (cmdWall - subWall)
-		default:
-			return XDuration(cmd.FinishTime().Sub(cmd.StartTime()))
-		}
-	default:
-		panic(errors.Errorf("invalid layout %q", globalLayout))
+// SortedSubMakes returns the command's sub-makes, in the order that they're drawn in.
+func (cmd *SVGCommand) SortedSubMakes() []*SVGMake {
+	keys := make([]string, 0, len(cmd.SubMakes))
+	for key := range cmd.SubMakes {
+		keys = append(keys, key)
 	}
-}
-
-func (cmd *SVGCommand) H() YLines {
-	sum := cmd.BaseH()
-	for _, submake := range cmd.SubMakes {
-		sum += submake.H()
+	sort.Strings(keys)
+	ret := make([]*SVGMake, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, cmd.SubMakes[key])
 	}
-	return sum
+	return ret
 }
 
-var commandTemplate = template.Must(template.
-	New("<x-command>").
-	Funcs(funcMap).
-	Parse(`<svg class="command"
-		    x="{{ .Attrs.X.PercentOf .Data.Parent.W }}" y="{{ .Attrs.Y.EM }}"
-		    width="{{ .Data.W.PercentOf .Data.Parent.W }}" height="{{ .Data.H.EM }}">
-		<title xml:space="preserve">{{ .Data.Title }}</title>
-		<rect class="background" x="0" y="0" width="100%" height="100%" />
-		<text x="0" y="0" dominant-baseline="hanging">
-			{{ $dy := "0" }}
-			{{ range $line := (.Data.Text | split "\n") }}
-				<tspan x="0" dy="{{ $dy }}" xml:space="preserve">{{ $line }}</tspan>
-				{{ $dy = (asYLines 1).EM }}
-			{{ end }}
-		</text>
-		{{ $yoff := .Data.BaseH }}
-		{{ range .Data.SubMakes }}
-			{{ $xoff := (.StartTime.Sub $.Data.StartTime) | asXDuration }}
-			{{ .SVG $xoff $yoff }}
-			{{ $yoff = $yoff.Add .H }}
-		{{ end }}
-	</svg>`))
-
-func (cmd *SVGCommand) SVG(X XDuration, Y YLines) (template.HTML, error) {
-	var str strings.Builder
-	err := commandTemplate.Execute(&str, map[string]interface{}{
-		"Attrs": map[string]interface{}{
-			"X": X,
-			"Y": Y,
-		},
-		"Data": cmd,
-	})
-	if err != nil {
-		return "", err
+func (cmd *SVGCommand) WriteSVG(v *view, w *svgWriter, box *Box, parentW XDuration) {
+	w.openBox("command", box, parentW, cmd.Title(v), cmd.Color(v))
+	w.printf(`<text x="0" y="0" dominant-baseline="hanging">` + "\n")
+	if v.VerboseCommand {
+		dy := "0"
+		for _, line := range cmd.Lines(v) {
+			w.printf(`<tspan x="0" dy="%s" xml:space="preserve">`, dy)
+			for _, span := range line {
+				if span.Class != "" {
+					w.printf(`<tspan class="sh-%s">%s</tspan>`, esc(span.Class), esc(span.Text))
+				} else {
+					w.printf(`%s`, esc(span.Text))
+				}
+			}
+			w.printf("</tspan>\n")
+			dy = YLines(1).EM()
+		}
+	} else {
+		w.printf(`<tspan x="0" dy="0" xml:space="preserve">%s</tspan>`+"\n", esc(cmd.Label(v)))
 	}
-	return template.HTML(str.String()), nil
+	w.printf("</text>\n")
+	box.writeChildren(v, w)
+	w.closeBox()
 }
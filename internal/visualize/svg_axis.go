@@ -0,0 +1,86 @@
+package visualize
+
+import (
+	"fmt"
+	"time"
+)
+
+// tickSteps are the candidate distances between labeled ticks on the time axis.
+var tickSteps = []time.Duration{
+	1 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	1 * time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second,
+	1 * time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	1 * time.Hour, 2 * time.Hour, 5 * time.Hour, 10 * time.Hour, 24 * time.Hour,
+}
+
+// targetTicks is roughly how many ticks we'd like on the time axis.
+const targetTicks = 10
+
+type Tick struct {
+	X     XDuration
+	Label string
+}
+
+// AxisH is the height of the time axis at the top of the profile.
+func (p *SVGProfile) AxisH(v *view) YLines {
+	if !v.TimeAxis {
+		return 0
+	}
+	return 2
+}
+
+// AxisCaption explains what the time axis measures.
+func (p *SVGProfile) AxisCaption(v *view) string {
+	caption := v.layout.Caption()
+	if p.Interrupted {
+		caption += " (the build was interrupted)"
+	}
+	return caption
+}
+
+func (p *SVGProfile) Ticks(v *view) []Tick {
+	total := time.Duration(p.W(v))
+	if total <= 0 {
+		return nil
+	}
+	step := tickSteps[len(tickSteps)-1]
+	for _, candidate := range tickSteps {
+		if candidate*targetTicks >= total {
+			step = candidate
+			break
+		}
+	}
+	var ticks []Tick
+	for t := time.Duration(0); t < total; t += step {
+		ticks = append(ticks, Tick{
+			X:     XDuration(t),
+			Label: t.String(),
+		})
+	}
+	return ticks
+}
+
+// RestartMarkers returns the positions at which the top-level make restarted, in layouts that
+// draw the restarts.
+func (p *SVGProfile) RestartMarkers(v *view) []Tick {
+	if !v.RestartMarkers || p.Make == nil {
+		return nil
+	}
+	var markers []Tick
+	for _, restart := range p.Make.Restarts {
+		if restart.RestartNum == 0 {
+			continue
+		}
+		x, ok := v.Timeline().find(restart)
+		if !ok {
+			continue
+		}
+		markers = append(markers, Tick{
+			X:     x,
+			Label: fmt.Sprintf("restart %d", restart.RestartNum),
+		})
+	}
+	return markers
+}
@@ -1,27 +1,16 @@
 package visualize
 
 import (
+	"bufio"
 	"fmt"
-	"html/template"
-	"strings"
+	"io"
+	"path/filepath"
+	"text/template"
 	"time"
 )
 
 const LineHeightEM = 1.2
 
-var (
-	globalProfile        *SVGProfile
-	globalLayout         string
-	globalVerboseCommand bool
-)
-
-var funcMap = template.FuncMap{
-	"asYLines":       func(y int) YLines { return YLines(y) },
-	"asXDuration":    func(x time.Duration) XDuration { return XDuration(x) },
-	"split":          func(sep, input string) []string { return strings.Split(input, sep) },
-	"verboseCommand": func() bool { return globalVerboseCommand },
-}
-
 type XDuration time.Duration
 
 func (d XDuration) PercentOf(parent XDuration) string {
@@ -45,12 +34,128 @@ func (y YLines) EM() string {
 type SVGElement interface {
 	StartTime() time.Time
 	FinishTime() time.Time
-	W() XDuration
-	H() YLines
-	SVG(x XDuration, y YLines) (template.HTML, error)
+	// WriteSVG draws the element in its box, and the box's children in it.
+	WriteSVG(v *view, w *svgWriter, box *Box, parentW XDuration)
 }
 
 var _ SVGElement = &SVGMake{}
 var _ SVGElement = &SVGRestart{}
 var _ SVGElement = &SVGRecipe{}
 var _ SVGElement = &SVGCommand{}
+var _ SVGElement = &SVGLane{}
+var _ SVGElement = &SVGBand{}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// A view is one rendering of one profile: the options that it's being rendered with, and what's
+// been worked out about it so far.  A view only lives for as long as one call to Renderer.Render,
+// so each render can use different options, and any number of them can run at once.
+type view struct {
+	Options
+	profile *SVGProfile
+	colors  *colorer
+	layout  Layout
+
+	timeline *Box
+	starts   map[SVGElement]time.Time
+	finishes map[SVGElement]time.Time
+}
+
+func newView(p *SVGProfile, opts Options) *view {
+	return &view{
+		Options: opts,
+		profile: p,
+		colors:  newColorer(p, opts.ColorBy),
+		layout:  lookupLayout(opts.Layout),
+
+		starts:   make(map[SVGElement]time.Time),
+		finishes: make(map[SVGElement]time.Time),
+	}
+}
+
+// Timeline returns the laid-out timeline; it's only laid out the first time that it's asked for.
+func (v *view) Timeline() *Box {
+	if v.timeline == nil {
+		v.timeline = v.layout.Place(v, v.profile)
+	}
+	return v.timeline
+}
+
+// startTime returns e.StartTime(), which is only worked out the first time that it's asked for;
+// a make's, restart's or recipe's is worked out from all of its children's.
+func (v *view) startTime(e SVGElement) time.Time {
+	start, ok := v.starts[e]
+	if !ok {
+		start = e.StartTime()
+		v.starts[e] = start
+	}
+	return start
+}
+
+// finishTime returns e.FinishTime(), which is only worked out the first time that it's asked for.
+func (v *view) finishTime(e SVGElement) time.Time {
+	finish, ok := v.finishes[e]
+	if !ok {
+		finish = e.FinishTime()
+		v.finishes[e] = finish
+	}
+	return finish
+}
+
+// rel returns the filename relative to the top-level make's directory, if possible.
+func (v *view) rel(filename string) string {
+	rel, err := filepath.Rel(v.profile.Make.Dir, filename)
+	if err != nil {
+		return filename
+	}
+	return rel
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// svgWriter writes SVG markup, remembering the first error so that the rendering code doesn't
+// have to check after every element.
+type svgWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func newSVGWriter(w io.Writer) *svgWriter {
+	return &svgWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *svgWriter) printf(format string, a ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, a...)
+}
+
+func (w *svgWriter) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// esc escapes text for use in an element's content or in an attribute value.
+func esc(text string) string {
+	return template.HTMLEscapeString(text)
+}
+
+// openBox starts one of the nested <svg> boxes that make up the profile: a make, restart, recipe,
+// or command.  It must be followed by a call to closeBox.
+func (w *svgWriter) openBox(class string, box *Box, parentW XDuration, title, color string) {
+	w.printf(`<svg class="%s" x="%s" y="%s" width="%s" height="%s">`+"\n",
+		class, box.X.PercentOf(parentW), box.Y.EM(), box.W.PercentOf(parentW), box.H.EM())
+	w.printf(`<title xml:space="preserve">%s</title>`+"\n", esc(title))
+	if color != "" {
+		w.printf(`<rect class="background" x="0" y="0" width="100%%" height="100%%" style="fill: %s" />`+"\n", esc(color))
+	} else {
+		w.printf(`<rect class="background" x="0" y="0" width="100%%" height="100%%" />` + "\n")
+	}
+}
+
+func (w *svgWriter) closeBox() {
+	w.printf("</svg>\n")
+}
@@ -0,0 +1,175 @@
+package visualize
+
+import (
+	"fmt"
+	"math"
+)
+
+// sampleTrackH is the height of each of the sample tracks.
+const sampleTrackH YLines = 2
+
+// A SampleTrack is a chart, drawn under the timeline, of one of the system-wide measurements that
+// `run --sample-interval` recorded during the build.
+type SampleTrack struct {
+	Label  string
+	Title  string
+	Points []SamplePoint
+	// Limit, if non-zero, is where to draw a line across the track, as a fraction of its
+	// height; for the load average, the number of CPUs.
+	Limit float64
+}
+
+type SamplePoint struct {
+	X XDuration
+	// Y is the value, as a fraction of the track's height.
+	Y float64
+}
+
+// SampleTracks returns the tracks to draw under the timeline; none if the build wasn't sampled, or
+// if the layout's X axis isn't wall-clock time.
+func (p *SVGProfile) SampleTracks(v *view) []*SampleTrack {
+	if len(p.Samples) == 0 {
+		return nil
+	}
+	if _, ok := v.layout.(wallclockAligned); !ok {
+		return nil
+	}
+
+	// track builds a track from the value of each sample, scaled so that max is the top.
+	track := func(value func(RawSample) float64, max float64) *SampleTrack {
+		t := new(SampleTrack)
+		if max <= 0 {
+			max = 1
+		}
+		for _, sample := range p.Samples {
+			t.Points = append(t.Points, SamplePoint{
+				X: XDuration(sample.Time.Sub(p.StartTime)),
+				Y: value(sample) / max,
+			})
+		}
+		return t
+	}
+
+	var maxLoad, sumBusy, maxMemUsed, maxSwapUsed float64
+	var maxMemTotal, maxSwapTotal, maxRead, maxWritten, maxIO uint64
+	for _, sample := range p.Samples {
+		maxLoad = math.Max(maxLoad, sample.LoadAvg)
+		sumBusy += sample.CPUBusy
+		maxMemUsed = math.Max(maxMemUsed, float64(sample.MemTotal-sample.MemAvailable))
+		maxSwapUsed = math.Max(maxSwapUsed, float64(sample.SwapTotal-sample.SwapFree))
+		if sample.MemTotal > maxMemTotal {
+			maxMemTotal = sample.MemTotal
+		}
+		if sample.SwapTotal > maxSwapTotal {
+			maxSwapTotal = sample.SwapTotal
+		}
+		if sample.DiskRead > maxRead {
+			maxRead = sample.DiskRead
+		}
+		if sample.DiskWritten > maxWritten {
+			maxWritten = sample.DiskWritten
+		}
+		if io := sample.DiskRead + sample.DiskWritten; io > maxIO {
+			maxIO = io
+		}
+	}
+
+	var tracks []*SampleTrack
+
+	// leave some room above the line for the number of CPUs, so that it can be seen
+	loadMax := math.Max(maxLoad, 1.25*float64(p.NumCPU))
+	load := track(func(s RawSample) float64 { return s.LoadAvg }, loadMax)
+	load.Label = fmt.Sprintf("load average (peak %.2f)", maxLoad)
+	load.Title = fmt.Sprintf("1-minute load average\nPeak: %.2f", maxLoad)
+	if p.NumCPU > 0 {
+		load.Label = fmt.Sprintf("load average (peak %.2f; %d CPUs)", maxLoad, p.NumCPU)
+		load.Title += fmt.Sprintf("\nCPUs: %d (the line)", p.NumCPU)
+		load.Limit = float64(p.NumCPU) / loadMax
+	}
+	tracks = append(tracks, load)
+
+	cpu := track(func(s RawSample) float64 { return s.CPUBusy }, 1)
+	meanBusy := sumBusy / float64(len(p.Samples))
+	cpu.Label = fmt.Sprintf("CPU utilization (mean %.0f%%)", 100*meanBusy)
+	cpu.Title = fmt.Sprintf("CPU utilization, of all CPUs\nMean: %.0f%%", 100*meanBusy)
+	tracks = append(tracks, cpu)
+
+	if maxMemTotal > 0 {
+		mem := track(func(s RawSample) float64 { return float64(s.MemTotal - s.MemAvailable) }, float64(maxMemTotal))
+		mem.Label = fmt.Sprintf("memory in use (peak %s of %s)", fmtBytes(maxMemUsed), fmtBytes(float64(maxMemTotal)))
+		mem.Title = fmt.Sprintf("Memory in use (not available for starting new programs without swapping)\n"+
+			"Peak: %s\n"+
+			"Total: %s",
+			fmtBytes(maxMemUsed), fmtBytes(float64(maxMemTotal)))
+		tracks = append(tracks, mem)
+	}
+
+	if maxSwapTotal > 0 {
+		swap := track(func(s RawSample) float64 { return float64(s.SwapTotal - s.SwapFree) }, float64(maxSwapTotal))
+		swap.Label = fmt.Sprintf("swap in use (peak %s of %s)", fmtBytes(maxSwapUsed), fmtBytes(float64(maxSwapTotal)))
+		swap.Title = fmt.Sprintf("Swap in use\n"+
+			"Peak: %s\n"+
+			"Total: %s",
+			fmtBytes(maxSwapUsed), fmtBytes(float64(maxSwapTotal)))
+		tracks = append(tracks, swap)
+	}
+
+	disk := track(func(s RawSample) float64 { return float64(s.DiskRead + s.DiskWritten) }, float64(maxIO))
+	disk.Label = fmt.Sprintf("disk I/O (peak %s/s)", fmtBytes(float64(maxIO)))
+	disk.Title = fmt.Sprintf("Disk I/O, read and written\n"+
+		"Peak read: %s/s\n"+
+		"Peak written: %s/s",
+		fmtBytes(float64(maxRead)), fmtBytes(float64(maxWritten)))
+	tracks = append(tracks, disk)
+
+	return tracks
+}
+
+// SampleTracksH is the height of the sample tracks under the timeline.
+func (p *SVGProfile) SampleTracksH(v *view) YLines {
+	return sampleTrackH * YLines(len(p.SampleTracks(v)))
+}
+
+// writeSampleTracks draws the sample tracks, starting at y.
+func (p *SVGProfile) writeSampleTracks(v *view, w *svgWriter, tracks []*SampleTrack, y YLines) {
+	W := p.W(v)
+	for _, track := range tracks {
+		w.printf(`<svg class="track" x="0" y="%s" width="100%%" height="%s">`+"\n", y.EM(), sampleTrackH.EM())
+		w.printf(`<title xml:space="preserve">%s</title>`+"\n", esc(track.Title))
+		w.printf(`<rect class="background" x="0" y="0" width="100%%" height="100%%" />` + "\n")
+		// The chart is drawn in a 1x1 box, stretched to fill the track.
+		w.printf(`<svg x="0" y="0" width="100%%" height="100%%" viewBox="0 0 1 1" preserveAspectRatio="none">` + "\n")
+		w.printf(`<polygon points="`)
+		if len(track.Points) > 0 {
+			w.printf(`%f,1 `, float64(track.Points[0].X)/float64(W))
+		}
+		for _, point := range track.Points {
+			w.printf(`%f,%f `, float64(point.X)/float64(W), 1-math.Min(point.Y, 1))
+		}
+		if len(track.Points) > 0 {
+			w.printf(`%f,1`, float64(track.Points[len(track.Points)-1].X)/float64(W))
+		}
+		w.printf(`" />` + "\n")
+		if track.Limit > 0 {
+			w.printf(`<line class="limit" x1="0" y1="%f" x2="1" y2="%f" />`+"\n", 1-track.Limit, 1-track.Limit)
+		}
+		w.printf("</svg>\n")
+		w.printf(`<text x="2" y="0" dominant-baseline="hanging">%s</text>`+"\n", esc(track.Label))
+		w.printf("</svg>\n")
+		y += sampleTrackH
+	}
+}
+
+// fmtBytes formats a number of bytes in binary units.
+func fmtBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -9,15 +9,19 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/datawire/profile-make/internal/merge"
+	"github.com/datawire/profile-make/internal/report"
 	"github.com/datawire/profile-make/internal/runmake"
-	"github.com/datawire/profile-make/internal/visualize"
 	"github.com/datawire/profile-make/internal/runshell"
+	"github.com/datawire/profile-make/internal/visualize"
 )
 
 var usageTmpl = template.Must(template.
 	New("--help").
 	Parse(`Usage: {{ .Arg0 }} run --output-file=FILE -- make [MAKE_ARGS]
    or: {{ .Arg0 }} visualize <PROFILE.json >PROFILE.svg
+   or: {{ .Arg0 }} merge [--offset=LABEL=DURATION] [LABEL=]PROFILE.json... >COMBINED.json
+   or: {{ .Arg0 }} report REPORT [REPORT_ARGS] <PROFILE.json
    or: {{ .Arg0 }} help
 Run GNU Make under a profiler.
 `))
@@ -48,6 +52,10 @@ func main() {
 		err = runshell.Main(os.Args[2:]...)
 	case "visualize":
 		err = visualize.Main(os.Args[2:]...)
+	case "merge":
+		err = merge.Main(os.Args[2:]...)
+	case "report":
+		err = report.Main(os.Args[2:]...)
 	default:
 		errusage(errors.Errorf("unrecognized sub-command: %q", os.Args[1]))
 	}
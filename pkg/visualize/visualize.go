@@ -0,0 +1,59 @@
+// Package visualize renders profiles recorded by `profile-make run`, just as `profile-make
+// visualize` does, for programs that want to render them themselves; for example, a CI dashboard
+// that draws each build's timeline.
+//
+//	profile, err := visualize.ReadProfileFile("profile.json.gz")
+//	if err != nil {
+//		return err
+//	}
+//	renderer, err := visualize.NewRenderer(visualize.Options{
+//		Format:   "svg",
+//		Layout:   "wallclock",
+//		TimeAxis: true,
+//		ColorBy:  "tool",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	return renderer.Render(w, profile)
+package visualize
+
+import (
+	"io"
+
+	"github.com/datawire/profile-make/internal/protocol"
+	"github.com/datawire/profile-make/internal/visualize"
+)
+
+type (
+	// Options are the ways that a profile can be rendered; they correspond to the flags of
+	// `profile-make visualize`.
+	Options = visualize.Options
+	// Filter controls which parts of a profile get rendered.
+	Filter = visualize.Filter
+	// A Renderer renders profiles with a fixed set of Options.  It's safe to use from several
+	// goroutines at once.
+	Renderer = visualize.Renderer
+
+	// A Profile is everything that `profile-make run` recorded about one build.
+	Profile = protocol.Profile
+	// A ProfiledCommand is one command that make ran, and the commands that it ran in turn.
+	ProfiledCommand = protocol.ProfiledCommand
+	// A Sample is a reading of the whole machine's resource usage, taken during the build.
+	Sample = protocol.Sample
+)
+
+// NewRenderer checks the options, and returns a Renderer that uses them.
+func NewRenderer(opts Options) (*Renderer, error) {
+	return visualize.NewRenderer(opts)
+}
+
+// ReadProfile reads a profile, decompressing it first if it's gzipped.
+func ReadProfile(r io.Reader) (Profile, error) {
+	return protocol.ReadProfile(r)
+}
+
+// ReadProfileFile is ReadProfile for a filename; "-" is stdin.
+func ReadProfileFile(filename string) (Profile, error) {
+	return protocol.ReadProfileFile(filename)
+}